@@ -0,0 +1,191 @@
+package dnscache
+
+// The addresses of the name servers, so a resolver does not have to
+// rely on the system resolver to find them.
+
+import (
+	// Standard packages
+	"net"
+	"time"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+type addressSet struct {
+	addresses []net.IP
+	expires   time.Time
+}
+
+// The IPv4 and IPv6 addresses of a host
+type hostAddresses struct {
+	v4   addressSet
+	v6   addressSet
+	cost int // Approximate memory use, counted in Cache.bytes
+}
+
+const (
+	addressOverhead = 120 // Rough size of a host, with its map slot
+	ipSize          = 40  // Slice header and a 16-byte address
+	// Minimum number of hosts before we look for expired ones
+	addressSweep = 64
+)
+
+func (h *hostAddresses) size(key string) int {
+	return addressOverhead + len(key) + ipSize*(len(h.v4.addresses)+len(h.v6.addresses))
+}
+
+// When neither family can be used anymore
+func (h *hostAddresses) expires() time.Time {
+	if h.v4.expires.After(h.v6.expires) {
+		return h.v4.expires
+	}
+	return h.v6.expires
+}
+
+func (s addressSet) valid(now time.Time) []net.IP {
+	if !now.Before(s.expires) {
+		return nil
+	}
+	return s.addresses
+}
+
+// Duplicates (the same glue twice in a message) are ignored
+func (s *addressSet) add(address net.IP) {
+	for _, known := range s.addresses {
+		if known.Equal(address) {
+			return
+		}
+	}
+	s.addresses = append(s.addresses, address)
+}
+
+// PutAddresses records the addresses of a name server, from the A and
+// AAAA records in rrs (glue or the answer to our own query). Records
+// of other types or other names are ignored. Each family is kept for
+// the smallest TTL of its records, and replaces what we knew before.
+// Only give the addresses of name servers: each host is an entry of
+// the cache, counted in the limits of Options.
+func (c *Cache) PutAddresses(host string, rrs []dns.RR) {
+	key := zoneKey(host)
+	v4 := addressSet{}
+	v6 := addressSet{}
+	var ttl4, ttl6 uint32
+	for _, rr := range rrs {
+		if zoneKey(rr.Header().Name) != key {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			if len(v4.addresses) == 0 || rr.Hdr.Ttl < ttl4 {
+				ttl4 = rr.Hdr.Ttl
+			}
+			v4.add(rr.A)
+		case *dns.AAAA:
+			if len(v6.addresses) == 0 || rr.Hdr.Ttl < ttl6 {
+				ttl6 = rr.Hdr.Ttl
+			}
+			v6.add(rr.AAAA)
+		}
+	}
+	if len(v4.addresses) == 0 && len(v6.addresses) == 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.clock()
+	v4.expires = now.Add(time.Duration(ttl4) * time.Second)
+	v6.expires = now.Add(time.Duration(ttl6) * time.Second)
+	c.putAddresses(key, v4, v6)
+}
+
+// Must be called with the lock held
+func (c *Cache) putAddresses(key string, v4 addressSet, v6 addressSet) {
+	host, ok := c.addresses[key]
+	if !ok {
+		if len(c.addresses) >= c.addressSweep {
+			c.sweepAddresses(c.clock().Add(-c.stale))
+		}
+		host = &hostAddresses{}
+		c.addresses[key] = host
+		c.entries++
+	}
+	if len(v4.addresses) > 0 {
+		host.v4 = v4
+	}
+	if len(v6.addresses) > 0 {
+		host.v6 = v6
+	}
+	old := host.cost
+	host.cost = host.size(key)
+	c.bytes += host.cost - old
+	if c.full() {
+		c.evict()
+	}
+}
+
+// Must be called with the lock held
+func (c *Cache) removeAddresses(key string) {
+	if host, ok := c.addresses[key]; ok {
+		delete(c.addresses, key)
+		c.entries--
+		c.bytes -= host.cost
+	}
+}
+
+// Removes the hosts whose addresses all expired. Called when the
+// number of hosts doubled since the last time, so the cost is
+// amortized over the insertions. Must be called with the lock held.
+func (c *Cache) sweepAddresses(now time.Time) {
+	for key, host := range c.addresses {
+		if !now.Before(host.expires()) {
+			c.removeAddresses(key)
+		}
+	}
+	c.addressSweep = 2 * len(c.addresses)
+	if c.addressSweep < addressSweep {
+		c.addressSweep = addressSweep
+	}
+}
+
+// Must be called with the lock held
+func (c *Cache) lookupAddresses(host string, now time.Time) []net.IP {
+	addresses, ok := c.addresses[zoneKey(host)]
+	if !ok {
+		return c.hints[zoneKey(host)]
+	}
+	v4 := addresses.v4.valid(now)
+	v6 := addresses.v6.valid(now)
+	if len(v4) == 0 && len(v6) == 0 {
+		return c.hints[zoneKey(host)]
+	}
+	result := make([]net.IP, 0, len(v4)+len(v6))
+	return append(append(result, v4...), v6...)
+}
+
+// Addresses returns the known addresses of a name server, IPv4 first,
+// nil if we do not know them.
+func (c *Cache) Addresses(host string) []net.IP {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.lookupAddresses(host, c.clock())
+}
+
+// StaleAddresses is Addresses with also the addresses which expired
+// less than Options.StaleWindow ago. Like GetStale, it is meant to be
+// used after a resolution failed.
+func (c *Cache) StaleAddresses(host string) []net.IP {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.lookupAddresses(host, c.clock().Add(-c.stale))
+}
+
+// Must be called with the lock held
+func (c *Cache) addressesOf(nameservers []string, now time.Time) map[string][]net.IP {
+	result := map[string][]net.IP{}
+	for _, ns := range nameservers {
+		if addresses := c.lookupAddresses(ns, now); addresses != nil {
+			result[ns] = addresses
+		}
+	}
+	return result
+}
@@ -0,0 +1,101 @@
+package dnscache
+
+import (
+	// Standard packages
+	"fmt"
+	"testing"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+func TestAddresses(me *testing.T) {
+	cache, clock := newFakeCache()
+	cache.Put("example", []string{"ns1.example", "ns2.example.net."}, defaultTTL)
+	// Glue, with an unrelated record
+	cache.PutAddresses("ns1.example.", []dns.RR{mustRR("ns1.example. 600 IN A 192.0.2.1"),
+		mustRR("ns1.example. 300 IN AAAA 2001:db8::1"), mustRR("ns3.example. 600 IN A 192.0.2.3")})
+	addresses := cache.Addresses("NS1.example")
+	if len(addresses) != 2 || !addresses[0].Equal(mustRR("a. 1 IN A 192.0.2.1").(*dns.A).A) {
+		me.Fatalf("Wrong addresses %v", addresses)
+	}
+	if cache.Addresses("ns3.example") != nil {
+		me.Fatal("Address of another name recorded")
+	}
+	ok, result, _ := cache.Get("www.example", dns.TypeA)
+	if len(result) != 0 {
+		me.Fail()
+	}
+	ok, result, _ = cache.Get("example", dns.TypeA)
+	if len(result) != 2 || len(ok.Addresses["ns1.example"]) != 2 {
+		me.Fatal("Addresses not returned with the name servers")
+	}
+	if _, known := ok.Addresses["ns2.example.net."]; known {
+		me.Fatal("Unknown addresses returned")
+	}
+	// Our own resolution
+	cache.PutAddresses("ns2.example.net", []dns.RR{mustRR("ns2.example.net. 600 IN AAAA 2001:db8::2")})
+	ok, _, _ = cache.Get("example", dns.TypeA)
+	if len(ok.Addresses["ns2.example.net."]) != 1 {
+		me.Fatal("Addresses not returned with the name servers")
+	}
+	clock.advance(300)
+	addresses = cache.Addresses("ns1.example")
+	if len(addresses) != 1 || addresses[0].To4() == nil {
+		me.Fatal("Each family should expire separately")
+	}
+	clock.advance(300)
+	if cache.Addresses("ns1.example") != nil {
+		me.Fatal("Expired addresses returned")
+	}
+}
+
+func TestRootAddresses(me *testing.T) {
+	cache := New(Options{Root: []string{"ns.test-root.example"}})
+	cache.PutAddresses("ns.test-root.example", []dns.RR{mustRR("ns.test-root.example. 600 IN A 127.0.0.1")})
+	ok, _, _ := cache.Get("", dns.TypeNS)
+	if len(ok.Addresses["ns.test-root.example"]) != 1 {
+		me.Fail()
+	}
+}
+
+func TestAddressesReplaced(me *testing.T) {
+	cache, _ := newFakeCache()
+	glue := []dns.RR{mustRR("ns.example. 600 IN A 192.0.2.1"), mustRR("ns.example. 600 IN A 192.0.2.1")}
+	for i := 0; i < 3; i++ { // The same referral several times
+		cache.PutAddresses("ns.example", glue)
+	}
+	if addresses := cache.Addresses("ns.example"); len(addresses) != 1 {
+		me.Fatalf("Duplicate addresses %v", addresses)
+	}
+	cache.PutAddresses("ns.example", []dns.RR{mustRR("ns.example. 600 IN A 192.0.2.2")}) // Renumbered
+	if addresses := cache.Addresses("ns.example"); len(addresses) != 1 || addresses[0].String() != "192.0.2.2" {
+		me.Fatalf("Old address kept %v", addresses)
+	}
+}
+
+func TestAddressesLimits(me *testing.T) {
+	clock := &fakeClock{}
+	cache := New(Options{Clock: clock.Now, MaxEntries: 100})
+	cache.PutAddresses("ns.example", []dns.RR{mustRR("ns.example. 600 IN A 192.0.2.1")})
+	if entries, bytes := cache.Size(); entries != 1 || bytes == 0 {
+		me.Fatalf("Addresses not counted: %d entries, %d bytes", entries, bytes)
+	}
+	clock.advance(600)
+	for i := 0; i < 2*addressSweep; i++ { // The expired host is swept
+		cache.PutAddresses(fmt.Sprintf("ns%d.example", i), []dns.RR{mustRR(fmt.Sprintf("ns%d.example. %d IN A 192.0.2.1", i, 1000+i))})
+	}
+	if _, known := cache.addresses[zoneKey("ns.example")]; known {
+		me.Fatal("Expired addresses kept")
+	}
+	entries, _ := cache.Size()
+	if entries > 100 || cache.Evictions() == 0 {
+		me.Fatalf("%d entries, more than the limit", entries)
+	}
+	if cache.Addresses("ns0.example") != nil || cache.Addresses(fmt.Sprintf("ns%d.example", 2*addressSweep-1)) == nil {
+		me.Fatal("The addresses which expire first should be evicted first")
+	}
+	cache.FlushBelow(".")
+	if entries, _ := cache.Size(); entries != 0 {
+		me.Fatalf("%d entries left after a flush", entries)
+	}
+}
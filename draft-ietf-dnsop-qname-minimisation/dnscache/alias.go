@@ -0,0 +1,80 @@
+package dnscache
+
+// Aliases: a CNAME record redirects its owner name, a DNAME record
+// (RFC 6672) redirects the names below its owner, for instance all of
+// a TLD if it is in the root zone.
+
+import (
+	// Standard packages
+	"time"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+// Maximum number of aliases Get follows, against loops
+const MaxAliases = 8
+
+// Must be called with the lock held. Returns the DNAME record of an
+// ancestor of the name, and the CNAME record it synthesizes, nil if
+// there is none.
+func (c *Cache) dname(labels []string, now time.Time) (dname dns.RR, cname *dns.CNAME) {
+	node := &c.root
+	for i := 0; i < len(labels)-1; i++ {
+		child, ok := node.children.get(labels[i])
+		if !ok {
+			return nil, nil
+		}
+		if records := child.records(dns.TypeDNAME, now); len(records) > 0 {
+			name := labelsName(labels[i+1:]) // Relative to the owner
+			target := dns.Fqdn(records[0].(*dns.DNAME).Target)
+			if target != "." {
+				name += "."
+			}
+			cname = &dns.CNAME{Hdr: dns.RR_Header{Name: dns.Fqdn(labelsName(labels)), Rrtype: dns.TypeCNAME,
+				Class: dns.ClassINET, Ttl: records[0].Header().Ttl}, Target: name + target}
+			return records[0], cname
+		}
+		node = child
+	}
+	return nil, nil
+}
+
+// Must be called with the lock held. cut is true if the name does not
+// exist because of a NXDOMAIN above it (RFC 8020).
+func (c *Cache) get(name string, qtype uint16, now time.Time) (reply Reply, nameservers []string, records []dns.RR, cut bool) {
+	chain := []dns.RR{}
+	target := ""
+	for aliases := 0; ; aliases++ {
+		if aliases > MaxAliases { // Probably a loop
+			reply, nameservers, records, cut = Reply{Exists: nil, NotAZone: nil, Closest: ""}, nil, nil, false
+			break
+		}
+		labels := c.labels(name) // Parsed once, it is the expensive part
+		if labels != nil {
+			if dname, cname := c.dname(labels, now); dname != nil {
+				chain = append(chain, dname, cname)
+				name = cname.Target
+				target = name
+				continue
+			}
+		}
+		reply, nameservers, records, cut = c.lookup(labels, qtype, now)
+		if qtype == dns.TypeCNAME || records != nil || reply.Exists == nil || !*reply.Exists || reply.NoData != nil {
+			break
+		}
+		// The name exists but we do not know about this type: may be
+		// it is an alias
+		_, _, cname, _ := c.lookup(labels, dns.TypeCNAME, now)
+		if len(cname) == 0 {
+			break
+		}
+		chain = append(chain, cname[0])
+		name = cname[0].(*dns.CNAME).Target
+		target = name
+	}
+	if target != "" {
+		reply.Target = zoneKey(target)
+		records = append(chain, records...)
+	}
+	return reply, nameservers, records, cut
+}
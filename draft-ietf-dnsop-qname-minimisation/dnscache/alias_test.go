@@ -0,0 +1,89 @@
+package dnscache
+
+import (
+	// Standard packages
+	"testing"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+func TestCNAME(me *testing.T) {
+	cache := New(Options{})
+	cache.PutRRset("www.example", dns.TypeCNAME, []dns.RR{mustRR("www.example. 600 IN CNAME server.hosting.example.")})
+	cache.PutRRset("server.hosting.example", dns.TypeA, []dns.RR{mustRR("server.hosting.example. 300 IN A 192.0.2.1")})
+	ok, _, records := cache.Get("www.example", dns.TypeA)
+	if ok.Target != "server.hosting.example" || ok.NoData == nil || *ok.NoData || len(records) != 2 ||
+		records[0].Header().Rrtype != dns.TypeCNAME || records[1].Header().Rrtype != dns.TypeA {
+		me.Fatalf("CNAME not followed: %+v %v", ok, records)
+	}
+	// Asking for the CNAME itself
+	ok, _, records = cache.Get("www.example", dns.TypeCNAME)
+	if ok.Target != "" || len(records) != 1 {
+		me.Fatal("CNAME followed for a CNAME query")
+	}
+	// The target is not in the cache: the caller must resolve it
+	ok, _, records = cache.Get("www.example", dns.TypeAAAA)
+	if ok.Target != "server.hosting.example" || ok.NoData != nil || len(records) != 1 || ok.Closest != "" {
+		me.Fatalf("Wrong reply for an unknown target: %+v", ok)
+	}
+	// The target does not exist
+	cache.PutRRset("mail.example", dns.TypeCNAME, []dns.RR{mustRR("mail.example. 600 IN CNAME nx.hosting.example.")})
+	cache.PutNx("nx.hosting.example", 300)
+	ok, _, records = cache.Get("mail.example", dns.TypeA)
+	if ok.Target != "nx.hosting.example" || ok.Exists == nil || *ok.Exists || len(records) != 1 {
+		me.Fatal("Wrong reply for a non-existing target")
+	}
+}
+
+func TestCNAMELoop(me *testing.T) {
+	cache := New(Options{})
+	cache.PutRRset("a.example", dns.TypeCNAME, []dns.RR{mustRR("a.example. 600 IN CNAME b.example.")})
+	cache.PutRRset("b.example", dns.TypeCNAME, []dns.RR{mustRR("b.example. 600 IN CNAME a.example.")})
+	ok, _, records := cache.Get("a.example", dns.TypeA)
+	if ok.Exists != nil || len(records) != MaxAliases+1 {
+		me.Fatalf("Loop not stopped: %d records", len(records))
+	}
+}
+
+// RFC 7535-like redirection of a TLD by a DNAME in the root zone
+func TestDNAMEAtRoot(me *testing.T) {
+	cache := New(Options{})
+	cache.PutRRset("local", dns.TypeDNAME, []dns.RR{mustRR("local. 86400 IN DNAME empty.as112.arpa.")})
+	cache.Put("empty.as112.arpa", []string{"blackhole.as112.arpa"}, 3600)
+	cache.PutNx("printer.empty.as112.arpa", 300)
+	ok, _, records := cache.Get("printer.LOCAL.", dns.TypeA)
+	if ok.Target != "printer.empty.as112.arpa" || ok.Exists == nil || *ok.Exists || len(records) != 2 {
+		me.Fatalf("DNAME not followed: %+v %v", ok, records)
+	}
+	cname, isCNAME := records[1].(*dns.CNAME)
+	if records[0].Header().Rrtype != dns.TypeDNAME || !isCNAME ||
+		cname.Hdr.Name != "printer.local." || cname.Target != "printer.empty.as112.arpa." {
+		me.Fatalf("Wrong synthesized CNAME %v", records[1])
+	}
+	ok, _, _ = cache.Get("scanner.local", dns.TypeA)
+	if ok.Target != "scanner.empty.as112.arpa" || ok.Exists != nil || ok.Closest != "empty.as112.arpa" {
+		me.Fatalf("Wrong zone cut for the target: %+v", ok)
+	}
+	// The owner itself is not redirected
+	ok, _, records = cache.Get("local", dns.TypeDNAME)
+	if ok.Target != "" || len(records) != 1 {
+		me.Fatal("Owner of the DNAME redirected")
+	}
+	// A DNAME to the root
+	cache.PutRRset("alias.example", dns.TypeDNAME, []dns.RR{mustRR("alias.example. 600 IN DNAME .")})
+	ok, _, _ = cache.Get("printer.local.alias.example", dns.TypeA)
+	if ok.Target != "printer.empty.as112.arpa" {
+		me.Fatalf("Wrong target %s", ok.Target)
+	}
+}
+
+func TestDNAMETooLong(me *testing.T) {
+	cache := New(Options{})
+	long := "abcdefghijabcdefghijabcdefghijabcdefghijabcdefghij"
+	cache.PutRRset("short.example", dns.TypeDNAME,
+		[]dns.RR{mustRR("short.example. 600 IN DNAME " + long + "." + long + "." + long + "." + long + ".example.")})
+	ok, _, _ := cache.Get(long+"."+long+".short.example", dns.TypeA)
+	if ok.Exists != nil { // RFC 6672, section 2.2: YXDOMAIN, we know nothing
+		me.Fatal("Too long name synthesized")
+	}
+}
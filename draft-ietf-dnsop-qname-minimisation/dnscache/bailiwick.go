@@ -0,0 +1,130 @@
+package dnscache
+
+// Bailiwick checking: the name servers of a zone are only believed for
+// the names of this zone (RFC 2181, section 5.4.1), otherwise the
+// servers of .de could tell us the name servers of example.com.
+
+import (
+	// Standard packages
+	"errors"
+	"time"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+var (
+	ErrOutOfBailiwick = errors.New("Name not in the zone of the server")
+	// We already have unexpired data from a zone closer to the name
+	ErrLessCredible = errors.New("Data from a zone more distant than the one of the cached data")
+	// None of the records has the name and the type of the RRset
+	ErrNotInRRset = errors.New("Records of another name or type")
+)
+
+// True if the labels (from the rightmost one) are the ones of zone or
+// of a name below
+func below(labels []string, zone []string) bool {
+	if len(labels) < len(zone) {
+		return false
+	}
+	for i := range zone {
+		if labels[i] != zone[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Must be called with the lock held. qtype is the one of the data, 0
+// for the name servers or the non-existence.
+func (c *Cache) checkBailiwick(labels []string, zone string, qtype uint16, now time.Time) error {
+	zoneLabels := c.labels(zone)
+	if zoneLabels == nil || !below(labels, zoneLabels) {
+		return ErrOutOfBailiwick
+	}
+	node := c.root.find(labels)
+	if node == nil {
+		return nil
+	}
+	previous, expires := node.zone, node.expires
+	if qtype != 0 {
+		previous, expires = node.data[qtype].zone, node.data[qtype].expires
+	}
+	// The child zone knows better than its parent
+	if previous != "" && now.Before(expires) && len(c.labels(previous)) > len(zoneLabels) {
+		return ErrLessCredible
+	}
+	return nil
+}
+
+// Returns the records whose owner is in zone, the others are counted
+// as rejected.
+func (c *Cache) inBailiwick(zone string, rrs []dns.RR) []dns.RR {
+	zoneLabels := c.labels(zone)
+	result := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if labels := c.labels(rr.Header().Name); zoneLabels != nil && labels != nil && below(labels, zoneLabels) {
+			result = append(result, rr)
+		}
+	}
+	if len(result) < len(rrs) {
+		c.lock.Lock()
+		c.rejections += uint64(len(rrs) - len(result))
+		c.lock.Unlock()
+	}
+	return result
+}
+
+// Returns the records of name and qtype (of any type for
+// dns.TypeANY), the others are counted as rejected.
+func (c *Cache) inRRset(name string, qtype uint16, rrs []dns.RR) []dns.RR {
+	labels := c.labels(name)
+	result := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if qtype != dns.TypeANY && rr.Header().Rrtype != qtype {
+			continue
+		}
+		if owner := c.labels(rr.Header().Name); labels != nil && owner != nil && len(owner) == len(labels) && below(owner, labels) {
+			result = append(result, rr)
+		}
+	}
+	if len(result) < len(rrs) {
+		c.lock.Lock()
+		c.rejections += uint64(len(rrs) - len(result))
+		c.lock.Unlock()
+	}
+	return result
+}
+
+// PutAddressesIn is PutAddresses for glue (or an answer) from the name
+// servers of zone. It is rejected if host is not in zone.
+func (c *Cache) PutAddressesIn(zone string, host string, rrs []dns.RR) error {
+	zoneLabels := c.labels(zone)
+	labels := c.labels(host)
+	if zoneLabels == nil || labels == nil || !below(labels, zoneLabels) {
+		offered := 0 // Records we would have used
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeA || rr.Header().Rrtype == dns.TypeAAAA {
+				if zoneKey(rr.Header().Name) == zoneKey(host) {
+					offered++
+				}
+			}
+		}
+		if offered == 0 {
+			return nil
+		}
+		c.lock.Lock()
+		c.rejections += uint64(offered)
+		c.lock.Unlock()
+		return ErrOutOfBailiwick
+	}
+	c.PutAddresses(host, rrs)
+	return nil
+}
+
+// Rejections returns the number of records rejected by the bailiwick
+// checks since the creation of the cache.
+func (c *Cache) Rejections() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.rejections
+}
@@ -0,0 +1,145 @@
+package dnscache
+
+import (
+	// Standard packages
+	"testing"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+func TestBailiwick(me *testing.T) {
+	tests := []struct {
+		zone   string
+		name   string
+		accept bool
+	}{
+		{"com", "example.com", true},
+		{"com.", "Example.COM.", true},
+		{".", "example.com", true},
+		{"example.com", "example.com", true}, // The apex NS, from the zone itself
+		{"example.com", "www.example.com", true},
+		{"de", "example.com", false},
+		{"example.com", "com", false},            // Trying to hijack the TLD
+		{"example.com", "badexample.com", false}, // A suffix, not a parent
+		{"example.com", "example.com.evil", false},
+		{`a\.example.com`, "a.example.com", false},
+	}
+	for _, test := range tests {
+		cache := New(Options{})
+		err := cache.PutIn(test.zone, test.name, []string{"ns.attacker.example"}, 600)
+		ok, _, _ := cache.Get(test.name, dns.TypeNS)
+		accepted := ok.NotAZone != nil && !*ok.NotAZone
+		if (err == nil) != test.accept || accepted != test.accept {
+			me.Errorf("Referral for %s from %s: accepted %v, expected %v", test.name, test.zone, accepted, test.accept)
+		}
+		if !test.accept && (err != ErrOutOfBailiwick || cache.Rejections() != 1) {
+			me.Errorf("Referral for %s from %s: rejection not counted", test.name, test.zone)
+		}
+	}
+}
+
+// The classic Kaminsky-style pattern: extra records for a name of
+// another zone in the answer
+func TestBailiwickAnswer(me *testing.T) {
+	cache := New(Options{})
+	err := cache.PutRRsetIn("example.com", "www.example.com", dns.TypeA,
+		[]dns.RR{mustRR("www.example.com. 300 IN A 192.0.2.1"), mustRR("www.bank.example. 300 IN A 192.0.2.66")})
+	if err != nil {
+		me.Fatalf("Answer rejected: %s", err)
+	}
+	_, _, records := cache.Get("www.example.com", dns.TypeA)
+	if len(records) != 1 || records[0].Header().Name != "www.example.com." {
+		me.Fatalf("Out of bailiwick record kept: %v", records)
+	}
+	if cache.Rejections() != 1 || cache.Stats().Rejections != 1 {
+		me.Fatal("Rejection not counted")
+	}
+	if cache.PutRRsetIn("example.com", "www.bank.example", dns.TypeA,
+		[]dns.RR{mustRR("www.bank.example. 300 IN A 192.0.2.66")}) == nil {
+		me.Fatal("Answer for another zone accepted")
+	}
+	if ok, _, _ := cache.Get("www.bank.example", dns.TypeA); ok.Exists != nil {
+		me.Fatal("Answer for another zone stored")
+	}
+	if cache.PutNxIn("example.com", "bank.example", "ns.example.com", 300) != ErrOutOfBailiwick ||
+		cache.PutNoDataIn("example.com", "bank.example", dns.TypeMX, 300) != ErrOutOfBailiwick {
+		me.Fatal("Negative answer for another zone accepted")
+	}
+}
+
+// Records which are not of the RRset, even in the zone
+func TestRRsetMismatch(me *testing.T) {
+	cache := New(Options{})
+	err := cache.PutRRsetIn("example.com", "www.example.com", dns.TypeA, []dns.RR{
+		mustRR("WWW.Example.COM. 300 IN A 192.0.2.1"),        // Case does not matter
+		mustRR("mail.example.com. 300 IN A 192.0.2.66"),      // Another owner
+		mustRR("www.example.com. 300 IN AAAA 2001:db8::66")}) // Another type
+	if err != nil {
+		me.Fatal(err)
+	}
+	_, _, records := cache.Get("www.example.com", dns.TypeA)
+	if len(records) != 1 || records[0].(*dns.A).A.String() != "192.0.2.1" {
+		me.Fatalf("Wrong records %v", records)
+	}
+	if cache.Rejections() != 2 {
+		me.Fatalf("%d rejections instead of 2", cache.Rejections())
+	}
+	if cache.PutRRset("ftp.example.com", dns.TypeTXT, []dns.RR{mustRR("ftp.example.com. 300 IN A 192.0.2.66")}); cache.Rejections() != 3 {
+		me.Fatal("Records of another type accepted without a zone")
+	}
+	if cache.PutRRsetIn("example.com", "ftp.example.com", dns.TypeA, []dns.RR{mustRR("www.example.com. 300 IN A 192.0.2.66")}) != ErrNotInRRset {
+		me.Fatal("Records of another name accepted")
+	}
+	if _, _, records := cache.Get("ftp.example.com", dns.TypeA); len(records) != 0 {
+		me.Fatal("Records stored under another name")
+	}
+}
+
+// Glue for name servers which are not in the zone
+func TestBailiwickGlue(me *testing.T) {
+	cache := New(Options{})
+	glue := []dns.RR{mustRR("ns.example.com. 300 IN A 192.0.2.1"), mustRR("ns.bank.example. 300 IN A 192.0.2.66")}
+	if cache.PutAddressesIn("com", "ns.example.com", glue) != nil {
+		me.Fatal("In-bailiwick glue rejected")
+	}
+	if cache.PutAddressesIn("com", "ns.bank.example", glue) != ErrOutOfBailiwick {
+		me.Fatal("Out of bailiwick glue accepted")
+	}
+	if len(cache.Addresses("ns.example.com")) != 1 || cache.Addresses("ns.bank.example") != nil {
+		me.Fatal("Wrong addresses")
+	}
+}
+
+// Data from the child zone is not replaced by what the parent says,
+// until it expires
+func TestCredibility(me *testing.T) {
+	cache, clock := newFakeCache()
+	if cache.PutIn("com", "example.com", []string{"ns1.example.com"}, 600) != nil ||
+		cache.PutIn("example.com", "example.com", []string{"ns2.example.com"}, 300) != nil {
+		me.Fatal("Delegation rejected")
+	}
+	if cache.PutIn("com", "example.com", []string{"ns.attacker.example"}, 600) != ErrLessCredible {
+		me.Fatal("Parent replaced the data of the child")
+	}
+	_, nameservers, _ := cache.Get("example.com", dns.TypeNS)
+	if len(nameservers) != 1 || nameservers[0] != "ns2.example.com" {
+		me.Fatalf("Wrong name servers %v", nameservers)
+	}
+	cache.PutRRsetIn("example.com", "www.example.com", dns.TypeA, []dns.RR{mustRR("www.example.com. 300 IN A 192.0.2.1")})
+	if cache.PutRRsetIn("com", "www.example.com", dns.TypeA, []dns.RR{mustRR("www.example.com. 300 IN A 192.0.2.66")}) != ErrLessCredible {
+		me.Fatal("Parent replaced the answer of the child")
+	}
+	// Another type is independent
+	if cache.PutRRsetIn("com", "www.example.com", dns.TypeAAAA, []dns.RR{mustRR("www.example.com. 300 IN AAAA 2001:db8::1")}) != nil {
+		me.Fatal("Answer for another type rejected")
+	}
+	// Without a zone, nothing is checked
+	cache.PutRRset("www.example.com", dns.TypeA, []dns.RR{mustRR("www.example.com. 300 IN A 192.0.2.2")})
+	clock.advance(301)
+	if cache.PutIn("com", "example.com", []string{"ns3.example.com"}, 600) != nil {
+		me.Fatal("Expired data not replaced")
+	}
+	if cache.Rejections() != 2 {
+		me.Fatalf("%d rejections instead of 2", cache.Rejections())
+	}
+}
@@ -6,93 +6,421 @@ package dnscache
 
 import (
 	// Standard packages
-	"strings"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unique"
 	// External packages
 	"github.com/miekg/dns"
 )
 
 type tree struct {
-	label       string
-	fqdn        string
+	label       unique.Handle[string] // Interned, see trie.go
+	parent      *tree                 // nil for the root
 	exists      bool
 	nameservers *[]string // If nil, we don't know. If nil and the array is empty, it means there is no zone cut,
 	// you find the name servers in a parent.
-	data     map[uint16][]dns.RR
-	children map[string]tree
+	source   string    // For a non-existing name, the server which told us so, if we know it
+	zone     string    // The zone whose name servers gave the name servers or the non-existence, "" if unknown
+	ttl      uint32    // TTL the node was learned with
+	expires  time.Time // Zero if the node never expires (root hints, nodes only created as parents)
+	data     map[uint16]rrset
+	children children
+	cost     int   // Approximate memory used by this node, see size()
+	lastUsed int64 // Unix time of the last Put or Get, accessed atomically
+	// Accessed atomically. Only the last node reached by a Get
+	// counts it, so readers of the same zone do not all write to the
+	// node of its apex. See popular for the delegations.
+	hits       uint64 // Number of Get stopping at this node
+	prefetched uint64 // Value of hits at the last prefetch of the data
+	zoneHits   uint64 // Hits of the subtree at the last prefetch of the name servers
+}
+
+type rrset struct {
+	records []dns.RR
+	nodata  bool // RFC 2308 NODATA: the name exists but has no records of this type
+	expires time.Time
+	zone    string // The zone whose name servers gave the answer, "" if unknown
 }
 
 type Reply struct {
 	Exists   *bool  // nil if we don't know
 	NotAZone *bool  // nil if we don't know
+	NoData   *bool  // nil if we don't know. True if the name exists but has no data of the requested type
 	Closest  string // No meaning if it is a zone. Otherwise, indicating the closest _known_ parent zone
+	// The known addresses of the returned name servers. Name servers
+	// whose addresses we do not know are absent.
+	Addresses map[string][]net.IP
+	Stale     bool // The reply uses expired data (RFC 8767), only with GetStale
+	// If aliases (CNAME or DNAME) were followed, the name they lead
+	// to. The rest of the reply is then about this name, and the
+	// records start with the aliases.
+	Target string
+}
+
+// Options of a new Cache. The zero value gives the usual defaults.
+type Options struct {
+	Root  []string         // Name servers of the root. If nil, the ones of Hints
+	Hints *Hints           // Root name servers and their addresses. If nil, DefaultHints()
+	Clock func() time.Time // Used to expire entries. If nil, time.Now
+	// Convert the U-labels of the names to A-labels (IDNA, RFC
+	// 5891), so that both forms give the same entry
+	IDNA bool
+	// Limits of the cache. Zero means no limit. When one is
+	// exceeded, the least recently used leaves are evicted.
+	MaxEntries int // Nodes (the root excepted), name servers with addresses and NSEC/NSEC3 records
+	MaxBytes   int // Approximate memory use
+	// What a cached NXDOMAIN tells about the names below. The
+	// default is NXDomainCutStrict.
+	NXDomainCut NXDomainCut
+	// How long after their expiration entries can still be
+	// returned by GetStale (RFC 8767). Zero disables it.
+	StaleWindow time.Duration
+}
+
+type Cache struct {
+	// Updated by Get, which only has the read lock, so accessed
+	// atomically. First in the struct so they are aligned on 32-bit
+	// platforms.
+	counters counters
+	root     tree
+	// Protects root and everything below. Get only reads the tree so
+	// readers do not block each other.
+	lock       sync.RWMutex
+	clock      func() time.Time
+	maxEntries int
+	maxBytes   int
+	entries    int
+	bytes      int
+	evictions  uint64
+	nxCut      NXDomainCut
+	brokenENT  map[string]bool           // Servers known to return NXDOMAIN for empty non-terminals
+	denials    map[string]*denial        // NSEC and NSEC3 records, indexed by zone
+	addresses  map[string]*hostAddresses // Of the name servers, indexed by their names
+	stale      time.Duration
+	rejections uint64 // Out of bailiwick data, see checkBailiwick
+	idna       bool
+	hints      map[string][]net.IP // Addresses of the root name servers, used when not in addresses
+	// Size of addresses above which the expired hosts are removed
+	addressSweep int
+	proofs       int // Records in denials
+	proofSweep   int // Like addressSweep
 }
 
 var (
-	root tree
+	// The cache used by the package-level functions
+	Default = New(Options{})
 	// So we can take their addresses
 	True  bool = true
 	False bool = false
+	// The name servers of the root only change with PutRoot, and it
+	// always exists
+	ErrRoot = errors.New("Cannot change the name servers or the existence of the root")
 )
 
-func (t *tree) put(name string, fqdn string, nx bool, ns []string) {
-	if name[len(name)-1] == '.' {
-		name = name[0 : len(name)-1]
+func New(options Options) *Cache {
+	hints := options.Hints
+	if hints == nil {
+		hints = defaultHints
+	}
+	ns := options.Root
+	if ns == nil {
+		ns = hints.Servers
+	}
+	clock := options.Clock
+	if clock == nil {
+		clock = time.Now
+	}
+	return &Cache{root: tree{label: intern(""), exists: true,
+		nameservers: &ns}, clock: clock,
+		maxEntries: options.MaxEntries, maxBytes: options.MaxBytes,
+		nxCut: options.NXDomainCut, brokenENT: map[string]bool{}, denials: map[string]*denial{},
+		addresses: map[string]*hostAddresses{}, stale: options.StaleWindow, idna: options.IDNA,
+		hints: hints.Addresses}
+}
+
+func (t *tree) expired(now time.Time) bool {
+	return !t.expires.IsZero() && !now.Before(t.expires)
+}
+
+// Returns a copy of the unexpired data of this type, with the TTL
+// set to the remaining lifetime
+func (t *tree) records(qtype uint16, now time.Time) []dns.RR {
+	set, ok := t.data[qtype]
+	if !ok || set.nodata || !now.Before(set.expires) {
+		return nil
 	}
-	labels := strings.Split(name, ".")
-	upperDomain := labels[len(labels)-1]
-	_, ok := t.children[upperDomain]
-	newFqdn := ""
+	remaining := uint32(set.expires.Sub(now) / time.Second)
+	result := make([]dns.RR, len(set.records))
+	for i := range set.records {
+		result[i] = dns.Copy(set.records[i])
+		result[i].Header().Ttl = remaining
+	}
+	return result
+}
+
+func (t *tree) touch(now time.Time) {
+	// Most of the time, the node was already used during this
+	// second, so we avoid writing to memory shared between readers.
+	if atomic.LoadInt64(&t.lastUsed) != now.Unix() {
+		atomic.StoreInt64(&t.lastUsed, now.Unix())
+	}
+}
+
+// Returns the cached answer for this type and, in nodata, whether we
+// know it is empty
+func (t *tree) answer(qtype uint16, now time.Time) (records []dns.RR, nodata *bool) {
+	set, ok := t.data[qtype]
+	if !ok || !now.Before(set.expires) {
+		return nil, nil
+	}
+	if set.nodata {
+		return nil, &True
+	}
+	return t.records(qtype, now), &False
+}
+
+// An answer proves that the name exists. If we believed otherwise, we
+// now know nothing more than that.
+func (t *tree) proveExistence(now time.Time) {
+	if !t.exists || t.expired(now) {
+		t.exists = true
+		t.source = ""
+		t.nameservers = nil
+		t.ttl = 0
+		t.expires = time.Time{}
+	}
+}
+
+// Records an answer, or its absence
+func (t *tree) setData(qtype uint16, set rrset, now time.Time) {
+	t.proveExistence(now)
+	if t.data == nil {
+		t.data = map[uint16]rrset{}
+	}
+	t.data[qtype] = set
+}
+
+// update is applied to the node of the name, which is created if
+// necessary. Returns the number of nodes created and the change in the
+// size of the tree.
+// labels are from the rightmost one, see Cache.labels.
+func (t *tree) put(labels []string, now time.Time, update func(node *tree, now time.Time)) (created int, delta int) {
+	upperDomain := labels[0]
+	child, ok := t.children.get(upperDomain)
 	if !ok {
-		if t.fqdn == "" {
-			newFqdn = upperDomain
-		} else {
-			newFqdn = upperDomain + "." + t.fqdn
-		}
-		t.children[upperDomain] = tree{label: upperDomain, fqdn: newFqdn, exists: true,
-			nameservers: nil, children: map[string]tree{}}
+		child = &tree{label: intern(upperDomain), parent: t, exists: true,
+			nameservers: nil}
+		t.children.add(child)
+		created = 1
+	} else if len(labels) > 1 {
+		// We learned something below: if the node is expired or was
+		// believed not to exist, it exists, but we know nothing else
+		// about it.
+		child.proveExistence(now)
 	}
 	if len(labels) == 1 {
-		// Famous issue 3117 http://stackoverflow.com/a/24221658/15625
-		// https://code.google.com/p/go/issues/detail?id=3117
-		tmp := t.children[upperDomain]
-		tmp.nameservers = &ns
-		tmp.exists = !nx
-		t.children[upperDomain] = tmp
+		update(child, now)
 	} else {
-		sname := strings.Join(labels[0:len(labels)-1], ".")
-		up := t.children[upperDomain]
-		up.put(sname, fqdn, nx, ns)
+		c, d := child.put(labels[1:], now, update)
+		created += c
+		delta += d
 	}
+	child.touch(now)
+	delta += child.resize()
+	return created, delta
 }
 
-func Put(name string, ns []string) {
-	if name == "" {
-		panic("Empty string: cannot Put the root")
+// Returns the node of the name, nil if it does not exist. labels are
+// from the rightmost one.
+func (t *tree) find(labels []string) *tree {
+	node := t
+	for _, label := range labels {
+		child, ok := node.children.get(label)
+		if !ok {
+			return nil
+		}
+		node = child
 	}
-	root.put(strings.ToLower(name), strings.ToLower(name), false, ns)
+	return node
 }
 
-func PutNx(name string) {
-	if name == "" {
-		panic("Empty string: cannot Put the root")
+// Invalid names are ignored. If zone is not "", the data comes from
+// the name servers of this zone and is checked, see checkBailiwick;
+// qtype is the type of the data, or 0 for the name servers or the
+// non-existence of the name.
+func (c *Cache) put(name string, zone string, qtype uint16, update func(node *tree, now time.Time)) error {
+	labels := c.labels(name)
+	if labels == nil {
+		return nil
+	}
+	if len(labels) == 0 && qtype == 0 {
+		return ErrRoot
 	}
-	root.put(strings.ToLower(name), strings.ToLower(name), true, []string{})
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.clock()
+	if zone != "" {
+		if err := c.checkBailiwick(labels, zone, qtype, now); err != nil {
+			c.rejections++
+			return err
+		}
+	}
+	if len(labels) == 0 { // Data of the root itself, for instance its SOA
+		update(&c.root, now)
+		c.root.touch(now)
+		c.bytes += c.root.resize()
+		return nil
+	}
+	c.detectBrokenENT(labels, now)
+	created, delta := c.root.put(labels, now, update)
+	c.entries += created
+	c.bytes += delta
+	if c.full() {
+		c.evict()
+	}
+	return nil
+}
+
+// Put records the name servers of a name, valid for ttl seconds. An
+// empty ns means that the name exists but is not a zone.
+func (c *Cache) Put(name string, ns []string, ttl uint32) {
+	c.PutIn("", name, ns, ttl)
 }
 
-func (t *tree) get(name string, qtype uint16, closest string) (reply Reply, nameservers []string, records []dns.RR) {
-	if name[len(name)-1] == '.' {
-		name = name[0 : len(name)-1]
+// PutIn is Put for a referral (or an answer) from the name servers of
+// zone. It is rejected if name is not in zone, or if we have better
+// information, from a zone closer to name. An empty zone means that
+// the origin is unknown, and nothing is checked.
+func (c *Cache) PutIn(zone string, name string, ns []string, ttl uint32) error {
+	return c.put(name, zone, 0, func(node *tree, now time.Time) {
+		node.nameservers = &ns
+		node.exists = true
+		node.source = ""
+		node.zone = zone
+		node.ttl = ttl
+		node.expires = now.Add(time.Duration(ttl) * time.Second)
+	})
+}
+
+// PutNx records that a name does not exist, for ttl seconds.
+func (c *Cache) PutNx(name string, ttl uint32) {
+	c.PutNxFrom(name, "", ttl)
+}
+
+// PutNxFrom records that a name does not exist, according to server,
+// for ttl seconds. The server matters for NXDomainCutHardened.
+func (c *Cache) PutNxFrom(name string, server string, ttl uint32) {
+	c.PutNxIn("", name, server, ttl)
+}
+
+// PutNxIn is PutNxFrom for a server of zone, checked like PutIn.
+func (c *Cache) PutNxIn(zone string, name string, server string, ttl uint32) error {
+	return c.put(name, zone, 0, func(node *tree, now time.Time) {
+		node.nameservers = &[]string{}
+		node.exists = false
+		node.source = server
+		node.zone = zone
+		node.ttl = ttl
+		node.expires = now.Add(time.Duration(ttl) * time.Second)
+		node.data = nil
+	})
+}
+
+// PutRRset records the answer to a query of type qtype. It is kept
+// for the smallest TTL of the records.
+func (c *Cache) PutRRset(name string, qtype uint16, rrs []dns.RR) {
+	c.PutRRsetIn("", name, qtype, rrs)
+}
+
+// PutRRsetIn is PutRRset for an answer from the name servers of zone,
+// checked like PutIn. Records whose owner is not name, whose type is
+// not qtype, or whose owner is not in zone, are dropped (and counted as
+// rejected).
+func (c *Cache) PutRRsetIn(zone string, name string, qtype uint16, rrs []dns.RR) error {
+	if len(rrs) == 0 {
+		return nil
+	}
+	if rrs = c.inRRset(name, qtype, rrs); len(rrs) == 0 {
+		return ErrNotInRRset
 	}
-	labels := strings.Split(name, ".")
-	upperDomain := labels[len(labels)-1]
+	if zone != "" {
+		if rrs = c.inBailiwick(zone, rrs); len(rrs) == 0 {
+			return ErrOutOfBailiwick
+		}
+	}
+	ttl := rrs[0].Header().Ttl
+	for i := range rrs {
+		if rrs[i].Header().Ttl < ttl {
+			ttl = rrs[i].Header().Ttl
+		}
+	}
+	return c.put(name, zone, qtype, func(node *tree, now time.Time) {
+		node.setData(qtype, rrset{records: rrs, expires: now.Add(time.Duration(ttl) * time.Second), zone: zone}, now)
+	})
+}
+
+// NegativeTTL returns how long a negative answer (NXDOMAIN or NODATA)
+// can be cached, from its authority section. RFC 2308, section 5: the
+// minimum of the SOA TTL and of the SOA MINIMUM field. No SOA, no
+// caching.
+func NegativeTTL(authority []dns.RR) uint32 {
+	for i := range authority {
+		soa, ok := authority[i].(*dns.SOA)
+		if ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				return soa.Minttl
+			}
+			return soa.Hdr.Ttl
+		}
+	}
+	return 0
+}
+
+// PutNoData records that a name exists but has no data of type
+// qtype, for ttl seconds.
+func (c *Cache) PutNoData(name string, qtype uint16, ttl uint32) {
+	c.PutNoDataIn("", name, qtype, ttl)
+}
+
+// PutNoDataIn is PutNoData for an answer from the name servers of
+// zone, checked like PutIn.
+func (c *Cache) PutNoDataIn(zone string, name string, qtype uint16, ttl uint32) error {
+	return c.put(name, zone, qtype, func(node *tree, now time.Time) {
+		node.setData(qtype, rrset{nodata: true, expires: now.Add(time.Duration(ttl) * time.Second), zone: zone}, now)
+	})
+}
+
+// denies tells if a non-existing node proves that the names below do
+// not exist either. labels are from the rightmost one.
+func (t *tree) get(labels []string, qtype uint16, closest *tree, now time.Time, denies func(node *tree) bool) (reply Reply, nameservers []string, records []dns.RR) {
+	upperDomain := labels[0]
 	closestParent := closest
-	if t.nameservers != nil && len(*t.nameservers) > 0 {
-		closestParent = t.fqdn
+	if t.nameservers != nil && len(*t.nameservers) > 0 && !t.expired(now) {
+		closestParent = t
+	}
+	child, ok := t.children.get(upperDomain)
+	if ok {
+		child.touch(now)
+		if len(labels) == 1 || (!child.expired(now) && !child.exists) { // We stop there
+			atomic.AddUint64(&child.hits, 1)
+		}
 	}
-	child, ok := t.children[upperDomain]
 	if !ok {
-		return Reply{Exists: nil, NotAZone: nil, Closest: closestParent}, nil, nil
+		atomic.AddUint64(&t.hits, 1)
+		return Reply{Exists: nil, NotAZone: nil, Closest: closestParent.name()}, nil, nil
+	} else if len(labels) == 1 && child.expired(now) {
+		records, nodata := child.answer(qtype, now)
+		if nodata == nil {
+			return Reply{Exists: nil, NotAZone: nil, Closest: closestParent.name()}, nil, nil
+		}
+		return Reply{Exists: &True, NotAZone: nil, NoData: nodata, Closest: closestParent.name()}, []string{}, records
 	} else {
+		if child.expired(now) { // We still may know things about its children
+			return child.get(labels[1:], qtype, closestParent, now, denies)
+		}
 		if !child.exists { /* Note this is a reasonable
 			   /* behaviour, since DNS is hierarchical but
 			   /* this is not how most resolvers work,
@@ -101,39 +429,118 @@ func (t *tree) get(name string, qtype uint16, closest string) (reply Reply, name
 			   /* for ENTs - Empty Non-terminals. See
 			   /* Internet-Draft
 			   /* draft-vixie-dnsext-resimprove, section
-			   /* 3*/
-			return Reply{Exists: &False, NotAZone: nil, Closest: closestParent}, nil, nil
+			   /* 3, later RFC 8020. Hence the choice in
+			   /* Options.NXDomainCut. */
+			if len(labels) == 1 || denies(child) {
+				return Reply{Exists: &False, NotAZone: nil, Closest: closestParent.name()}, nil, nil
+			}
+			return Reply{Exists: nil, NotAZone: nil, Closest: closestParent.name()}, nil, nil
 		} else {
 			if len(labels) == 1 {
+				records, nodata := child.answer(qtype, now)
 				if child.nameservers == nil {
-					return Reply{Exists: &True, NotAZone: nil, Closest: closestParent}, []string{}, nil
+					return Reply{Exists: &True, NotAZone: nil, NoData: nodata, Closest: closestParent.name()}, []string{}, records
 				} else {
 					notazone := len(*child.nameservers) == 0
 					if !notazone {
-						closestParent = child.fqdn
+						closestParent = child
 					}
-					return Reply{Exists: &True, NotAZone: &notazone, Closest: closestParent}, *child.nameservers, nil
+					return Reply{Exists: &True, NotAZone: &notazone, NoData: nodata, Closest: closestParent.name()}, *child.nameservers, records
 				}
 			} else {
-				sname := strings.Join(labels[0:len(labels)-1], ".")
-				return child.get(sname, qtype, closestParent)
+				return child.get(labels[1:], qtype, closestParent, now, denies)
 			}
 		}
 	}
 }
 
-func Get(name string, qtype uint16) (reply Reply, nameservers []string, records []dns.RR) {
-	if name == "" { // The root is special
-		return Reply{Exists: &True, NotAZone: &False, Closest: ""}, *root.nameservers, nil
+func (c *Cache) Get(name string, qtype uint16) (reply Reply, nameservers []string, records []dns.RR) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	reply, nameservers, records, cut := c.get(name, qtype, c.clock())
+	c.count(qtype, reply, records, cut)
+	return reply, nameservers, records
+}
+
+// Peek is Get without counting it in the Stats. Get is for the
+// queries of the clients, Peek for the lookups a resolver does on its
+// own, for instance to find the name servers of a zone.
+func (c *Cache) Peek(name string, qtype uint16) (reply Reply, nameservers []string, records []dns.RR) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	reply, nameservers, records, _ = c.get(name, qtype, c.clock())
+	return reply, nameservers, records
+}
+
+// Like get, without following the aliases. labels are the ones of
+// the name, see Cache.labels.
+func (c *Cache) lookup(labels []string, qtype uint16, now time.Time) (reply Reply, nameservers []string, records []dns.RR, cut bool) {
+	if labels == nil { // Invalid name, we know nothing
+		return Reply{Exists: nil, NotAZone: nil, Closest: ""}, nil, nil, false
+	}
+	if len(labels) == 0 { // The root is special
+		records, nodata := c.root.answer(qtype, now)
+		return Reply{Exists: &True, NotAZone: &False, NoData: nodata, Closest: "",
+			Addresses: c.addressesOf(*c.root.nameservers, now)}, *c.root.nameservers, records, false
 	}
-	return root.get(strings.ToLower(name), qtype, "")
+	denies := func(node *tree) bool {
+		cut = c.denies(node)
+		return cut
+	}
+	reply, nameservers, records = c.root.get(labels, qtype, &c.root, now, denies)
+	if reply.Exists == nil || (*reply.Exists && reply.NoData == nil) {
+		exists, nodata := c.aggressive(reply.Closest, labelsName(labels), qtype, now)
+		if exists != nil && (reply.Exists == nil || *exists) {
+			reply.Exists = exists
+			reply.NoData = nodata
+		}
+	}
+	reply.Addresses = c.addressesOf(nameservers, now)
+	return reply, nameservers, records, cut
+}
+
+// The package-level functions use the Default cache
+
+func Put(name string, ns []string, ttl uint32) {
+	Default.Put(name, ns, ttl)
+}
+
+func PutNx(name string, ttl uint32) {
+	Default.PutNx(name, ttl)
+}
+
+func PutRRset(name string, qtype uint16, rrs []dns.RR) {
+	Default.PutRRset(name, qtype, rrs)
+}
+
+func PutNxFrom(name string, server string, ttl uint32) {
+	Default.PutNxFrom(name, server, ttl)
+}
+
+func PutNoData(name string, qtype uint16, ttl uint32) {
+	Default.PutNoData(name, qtype, ttl)
+}
+
+func PutIn(zone string, name string, ns []string, ttl uint32) error {
+	return Default.PutIn(zone, name, ns, ttl)
+}
+
+func PutNxIn(zone string, name string, server string, ttl uint32) error {
+	return Default.PutNxIn(zone, name, server, ttl)
+}
+
+func PutRRsetIn(zone string, name string, qtype uint16, rrs []dns.RR) error {
+	return Default.PutRRsetIn(zone, name, qtype, rrs)
+}
+
+func PutNoDataIn(zone string, name string, qtype uint16, ttl uint32) error {
+	return Default.PutNoDataIn(zone, name, qtype, ttl)
+}
+
+func Get(name string, qtype uint16) (reply Reply, nameservers []string, records []dns.RR) {
+	return Default.Get(name, qtype)
 }
 
-func init() {
-	root = tree{label: "", fqdn: "", exists: true,
-		nameservers: &[]string{"a.root-servers.net", "b.root-servers.net", "c.root-servers.net",
-			"d.root-servers.net", "e.root-servers.net", "f.root-servers.net",
-			"g.root-servers.net", "h.root-servers.net", "i.root-servers.net",
-			"j.root-servers.net", "k.root-servers.net", "l.root-servers.net",
-			"m.root-servers.net"}, children: map[string]tree{}}
+func Peek(name string, qtype uint16) (reply Reply, nameservers []string, records []dns.RR) {
+	return Default.Peek(name, qtype)
 }
@@ -1,11 +1,18 @@
 package dnscache
 
 import (
+	// Standard packages
+	"fmt"
+	"sync"
 	"testing"
+	"time"
+	// External packages
+	"github.com/miekg/dns"
 )
 
 const (
 	defaultQtype = 1
+	defaultTTL   = 86400
 )
 
 func Test1rootExists(me *testing.T) {
@@ -136,11 +143,349 @@ func Test10unknownTldUnknown(me *testing.T) {
 	}
 }
 
+// A clock that only moves when the test says so
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) advance(seconds int) {
+	c.now = c.now.Add(time.Duration(seconds) * time.Second)
+}
+
+func newFakeCache() (*Cache, *fakeClock) {
+	clock := &fakeClock{now: time.Now().Truncate(time.Second)}
+	return New(Options{Clock: clock.Now}), clock
+}
+
+func Test11ttlExpires(me *testing.T) {
+	cache, clock := newFakeCache()
+	cache.Put("expiring.example", []string{"ns1.expiring.example"}, 60)
+	ok, result, _ := cache.Get("expiring.example", defaultQtype)
+	if ok.Exists == nil || !*ok.Exists || len(result) != 1 {
+		me.Fatal("Fresh entry not found")
+	}
+	clock.advance(59)
+	ok, _, _ = cache.Get("expiring.example", defaultQtype)
+	if ok.Exists == nil {
+		me.Fatal("Entry expired too early")
+	}
+	clock.advance(1)
+	ok, result, _ = cache.Get("expiring.example", defaultQtype)
+	if ok.Exists != nil || result != nil {
+		me.Fatal("Expired entry still returned")
+	}
+	// The parent zone is still here
+	if ok.Closest != "" {
+		me.Fail()
+	}
+}
+
+func Test12nxTtlExpires(me *testing.T) {
+	cache, clock := newFakeCache()
+	cache.PutNx("gone.example", 30)
+	ok, _, _ := cache.Get("www.gone.example", defaultQtype)
+	if ok.Exists == nil || *ok.Exists {
+		me.Fatal("NXDOMAIN not found")
+	}
+	clock.advance(30)
+	ok, _, _ = cache.Get("www.gone.example", defaultQtype)
+	if ok.Exists != nil {
+		me.Fatal("Expired NXDOMAIN still used")
+	}
+	ok, _, _ = cache.Get("gone.example", defaultQtype)
+	if ok.Exists != nil {
+		me.Fatal("Expired NXDOMAIN still used")
+	}
+}
+
+func Test13expiredParentKeepsChildren(me *testing.T) {
+	cache, clock := newFakeCache()
+	cache.Put("parent.example", []string{"ns.parent.example"}, 10)
+	cache.Put("child.parent.example", []string{"ns.child.parent.example"}, 100)
+	clock.advance(20)
+	ok, result, _ := cache.Get("www.child.parent.example", defaultQtype)
+	if ok.Exists != nil {
+		me.Fail()
+	}
+	if ok.Closest != "child.parent.example" {
+		me.Fatalf("Closest zone should be child.parent.example, not \"%s\"", ok.Closest)
+	}
+	ok, result, _ = cache.Get("child.parent.example", defaultQtype)
+	if ok.Exists == nil || !*ok.Exists || len(result) != 1 {
+		me.Fail()
+	}
+	ok, _, _ = cache.Get("other.parent.example", defaultQtype)
+	if ok.Closest != "" {
+		me.Fatalf("Expired zone parent.example should not be used, closest is \"%s\"", ok.Closest)
+	}
+}
+
+func Test14zeroTtlNotCached(me *testing.T) {
+	PutNx("volatile.example", 0)
+	ok, _, _ := Get("volatile.example", defaultQtype)
+	if ok.Exists != nil {
+		me.Fail()
+	}
+}
+
+func mustRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+func Test15rrsetCached(me *testing.T) {
+	cache, clock := newFakeCache()
+	cache.PutRRset("www.heise.de", dns.TypeA, []dns.RR{mustRR("www.heise.de. 300 IN A 193.99.144.85"),
+		mustRR("www.heise.de. 100 IN A 193.99.144.86")})
+	ok, _, records := cache.Get("www.heise.de", dns.TypeA)
+	if ok.Exists == nil || !*ok.Exists {
+		me.Fatal("Name with data does not exist")
+	}
+	if len(records) != 2 {
+		me.Fatalf("Expected 2 records, got %d", len(records))
+	}
+	if records[0].Header().Ttl != 100 { // The smallest TTL of the RRset
+		me.Fatalf("Wrong TTL %d", records[0].Header().Ttl)
+	}
+	_, _, records = cache.Get("www.heise.de", dns.TypeAAAA)
+	if records != nil {
+		me.Fatal("Data of the wrong type returned")
+	}
+	clock.advance(40)
+	_, _, records = cache.Get("www.heise.de", dns.TypeA)
+	if len(records) != 2 || records[1].Header().Ttl != 60 {
+		me.Fatal("TTL not decremented")
+	}
+	clock.advance(60)
+	_, _, records = cache.Get("www.heise.de", dns.TypeA)
+	if records != nil {
+		me.Fatal("Expired data returned")
+	}
+}
+
+func Test16rrsetInZone(me *testing.T) {
+	PutRRset("verisign.com", dns.TypeMX, []dns.RR{mustRR("verisign.com. 3600 IN MX 10 mail.verisign.com.")})
+	ok, result, records := Get("verisign.com", dns.TypeMX)
+	if ok.NotAZone == nil || *ok.NotAZone || len(result) != 2 { // Still a zone
+		me.Fail()
+	}
+	if len(records) != 1 {
+		me.Fail()
+	}
+}
+
+func Test17rrsetOverridesNx(me *testing.T) {
+	PutNx("ghost.example", defaultTTL)
+	PutRRset("ghost.example", dns.TypeTXT, []dns.RR{mustRR("ghost.example. 60 IN TXT \"boo\"")})
+	ok, _, records := Get("ghost.example", dns.TypeTXT)
+	if ok.Exists == nil || !*ok.Exists || len(records) != 1 {
+		me.Fail()
+	}
+}
+
+// Run it with -race
+func Test18concurrentAccess(me *testing.T) {
+	const (
+		goroutines = 32
+		iterations = 2000
+	)
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				name := fmt.Sprintf("n%d.g%d.concurrent.example", i%100, g%4)
+				switch i % 4 {
+				case 0:
+					Put(name, []string{"ns1." + name, "ns2." + name}, defaultTTL)
+				case 1:
+					PutNx("nx"+name, defaultTTL)
+				case 2:
+					PutRRset(name, dns.TypeA, []dns.RR{mustRR(name + " 300 IN A 192.0.2.1")})
+				}
+				ok, _, _ := Get(name, dns.TypeA)
+				if ok.Exists != nil && !*ok.Exists {
+					me.Errorf("%s should not be NXDOMAIN", name)
+					return
+				}
+				Get("www.heise.de", dns.TypeA)
+			}
+		}(g)
+	}
+	wg.Wait()
+	ok, result, _ := Get("heise.de", defaultQtype)
+	if ok.Exists == nil || !*ok.Exists || len(result) != 3 {
+		me.Fail()
+	}
+}
+
+func Test19independentInstances(me *testing.T) {
+	test := New(Options{Root: []string{"ns.test-root.example"}})
+	other := New(Options{})
+	test.Put("lab", []string{"ns.lab"}, defaultTTL)
+	ok, result, _ := test.Get("", defaultQtype)
+	if len(result) != 1 || result[0] != "ns.test-root.example" {
+		me.Fatal("Custom root not used")
+	}
+	_, result, _ = other.Get("", defaultQtype)
+	if len(result) != 13 {
+		me.Fatal("Default root not used")
+	}
+	ok, _, _ = test.Get("lab", defaultQtype)
+	if ok.Exists == nil || !*ok.Exists {
+		me.Fail()
+	}
+	ok, _, _ = other.Get("lab", defaultQtype)
+	if ok.Exists != nil {
+		me.Fatal("Data leaked to another instance")
+	}
+	ok, _, _ = Get("lab", defaultQtype)
+	if ok.Exists != nil {
+		me.Fatal("Data leaked to the default instance")
+	}
+	ok, _, _ = test.Get("heise.de", defaultQtype)
+	if ok.Exists != nil {
+		me.Fatal("Data of the default instance leaked")
+	}
+}
+
+func Test20noData(me *testing.T) {
+	cache, clock := newFakeCache()
+	cache.Put("nodata.example", []string{"ns.nodata.example"}, defaultTTL)
+	cache.PutRRset("www.nodata.example", dns.TypeA, []dns.RR{mustRR("www.nodata.example. 300 IN A 192.0.2.1")})
+	cache.PutNoData("www.nodata.example", dns.TypeAAAA, 60)
+	ok, _, records := cache.Get("www.nodata.example", dns.TypeAAAA)
+	if ok.Exists == nil || !*ok.Exists || ok.NoData == nil || !*ok.NoData || records != nil {
+		me.Fatal("NODATA not found")
+	}
+	ok, _, records = cache.Get("www.nodata.example", dns.TypeA)
+	if ok.NoData == nil || *ok.NoData || len(records) != 1 {
+		me.Fatal("NODATA for one type hides another type")
+	}
+	ok, _, _ = cache.Get("www.nodata.example", dns.TypeMX)
+	if ok.Exists == nil || !*ok.Exists || ok.NoData != nil {
+		me.Fatal("Unknown type is not unknown")
+	}
+	ok, _, _ = cache.Get("nodata.example", dns.TypeAAAA)
+	if ok.NoData != nil {
+		me.Fatal("NODATA applied to the parent")
+	}
+	clock.advance(60)
+	ok, _, _ = cache.Get("www.nodata.example", dns.TypeAAAA)
+	if ok.NoData != nil {
+		me.Fatal("Expired NODATA still used")
+	}
+	// Data replaces NODATA
+	cache.PutNoData("www.nodata.example", dns.TypeTXT, 60)
+	cache.PutRRset("www.nodata.example", dns.TypeTXT, []dns.RR{mustRR("www.nodata.example. 300 IN TXT \"here\"")})
+	ok, _, records = cache.Get("www.nodata.example", dns.TypeTXT)
+	if ok.NoData == nil || *ok.NoData || len(records) != 1 {
+		me.Fail()
+	}
+	// NXDOMAIN replaces everything
+	cache.PutNx("www.nodata.example", 60)
+	ok, _, _ = cache.Get("www.nodata.example", dns.TypeA)
+	if ok.Exists == nil || *ok.Exists || ok.NoData != nil {
+		me.Fail()
+	}
+}
+
+func Test21negativeTTL(me *testing.T) {
+	soa := mustRR("example. 3600 IN SOA ns.example. hostmaster.example. 1 7200 3600 604800 300")
+	if NegativeTTL([]dns.RR{soa}) != 300 {
+		me.Fatal("SOA MINIMUM not used")
+	}
+	soa.Header().Ttl = 60
+	if NegativeTTL([]dns.RR{mustRR("example. 60 IN NS ns.example."), soa}) != 60 {
+		me.Fatal("SOA TTL not used")
+	}
+	if NegativeTTL([]dns.RR{}) != 0 {
+		me.Fatal("Negative answer without SOA cached")
+	}
+}
+
+func populate(n int) []string {
+	names := make([]string, n)
+	for i := 0; i < n; i++ {
+		names[i] = fmt.Sprintf("www.domain%d.bench.example", i)
+		Put(fmt.Sprintf("domain%d.bench.example", i), []string{"ns1.example.net", "ns2.example.net"}, defaultTTL)
+	}
+	return names
+}
+
+func BenchmarkGet(b *testing.B) {
+	names := populate(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Get(names[i%len(names)], dns.TypeA)
+	}
+}
+
+func BenchmarkParallelGet(b *testing.B) {
+	names := populate(10000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			Get(names[i%len(names)], dns.TypeA)
+			i++
+		}
+	})
+}
+
+func BenchmarkParallelGetPut(b *testing.B) {
+	names := populate(10000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if i%10 == 0 {
+				PutNx(names[i%len(names)], defaultTTL)
+			} else {
+				Get(names[i%len(names)], dns.TypeA)
+			}
+			i++
+		}
+	})
+}
+
 func init() {
-	Put("de", []string{"ns1.denic.de"})
-	Put("verisign.com", []string{"ns1", "ns2"})
-	Put("www.verisign.com", []string{})
-	Put("heise.de.", []string{"ns1.1and1.net", "slave.isc.org", "ns.netnod.net"}) // Test that the final dot is ignored
-	PutNx("tagada")
-	PutNx("google.de")
+	Put("de", []string{"ns1.denic.de"}, defaultTTL)
+	Put("verisign.com", []string{"ns1", "ns2"}, defaultTTL)
+	Put("www.verisign.com", []string{}, defaultTTL)
+	Put("heise.de.", []string{"ns1.1and1.net", "slave.isc.org", "ns.netnod.net"}, defaultTTL) // Test that the final dot is ignored
+	PutNx("tagada", defaultTTL)
+	PutNx("google.de", defaultTTL)
+}
+
+func TestRootData(me *testing.T) {
+	cache, _ := newFakeCache()
+	soa := mustRR(". 86400 IN SOA a.root-servers.net. nstld.verisign-grs.com. 1 1800 900 604800 86400")
+	if err := cache.PutRRsetIn(".", ".", dns.TypeSOA, []dns.RR{soa}); err != nil {
+		me.Fatalf("SOA of the root not stored: %s", err)
+	}
+	ok, nameservers, records := cache.Get(".", dns.TypeSOA)
+	if ok.NoData == nil || *ok.NoData || len(records) != 1 || len(nameservers) == 0 {
+		me.Fatalf("SOA of the root not retrieved: %v", records)
+	}
+	if err := cache.PutNoDataIn(".", ".", dns.TypeMX, 300); err != nil {
+		me.Fatalf("NODATA of the root not stored: %s", err)
+	}
+	if ok, _, _ := cache.Get("", dns.TypeMX); ok.NoData == nil || !*ok.NoData {
+		me.Fatal("NODATA of the root not retrieved")
+	}
+	if cache.PutNxIn(".", ".", "ns.example", 300) != ErrRoot || cache.PutIn(".", ".", []string{"ns.evil"}, 300) != ErrRoot {
+		me.Fatal("Name servers or existence of the root changed")
+	}
+	if ok, nameservers, _ := cache.Get(".", dns.TypeNS); ok.Exists == nil || !*ok.Exists || len(nameservers) == 0 {
+		me.Fatal("Root lost")
+	}
 }
@@ -0,0 +1,173 @@
+package dnscache
+
+// Eviction of the least recently used entries, when the cache exceeds
+// the limits set in Options.
+
+import (
+	// Standard packages
+	"sort"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+const (
+	nodeOverhead       = 176 // Rough size of an empty node, see trie.go
+	nameserverOverhead = 16  // String header
+	// When evicting, we go a bit below the limit so we do not have
+	// to walk the tree again at the next Put.
+	evictionSlack = 10 // Percent of the limit
+)
+
+type leaf struct {
+	parent *tree
+	node   *tree
+}
+
+// Approximate memory use of the node, not counting its children
+func (t *tree) size() int {
+	size := nodeOverhead // Labels are interned
+	if t.nameservers != nil {
+		for _, ns := range *t.nameservers {
+			size += nameserverOverhead + len(ns)
+		}
+	}
+	for _, set := range t.data {
+		for _, rr := range set.records {
+			size += dns.Len(rr)
+		}
+	}
+	return size
+}
+
+// Updates the cost of the node and returns its change
+func (t *tree) resize() int {
+	old := t.cost
+	t.cost = t.size()
+	return t.cost - old
+}
+
+func (t *tree) leaves(result []leaf) []leaf {
+	t.children.each(func(child *tree) {
+		if child.children.len() == 0 {
+			result = append(result, leaf{parent: t, node: child})
+		} else {
+			result = child.leaves(result)
+		}
+	})
+	return result
+}
+
+func (c *Cache) full() bool {
+	return (c.maxEntries > 0 && c.entries > c.maxEntries) ||
+		(c.maxBytes > 0 && c.bytes > c.maxBytes)
+}
+
+func (c *Cache) aboveTarget() bool {
+	return (c.maxEntries > 0 && c.entries > c.maxEntries-c.maxEntries*evictionSlack/100) ||
+		(c.maxBytes > 0 && c.bytes > c.maxBytes-c.maxBytes*evictionSlack/100)
+}
+
+// Only leaves are evicted so a zone cut stays as long as something
+// below it is in the cache. Removing leaves may create new ones, hence
+// the loop. The NSEC and NSEC3 records of a zone go together, before
+// the leaves used more recently. The addresses of the name servers go
+// when they expired, or when nothing is left in the tree. Must be
+// called with the lock held.
+func (c *Cache) evict() {
+	c.sweepAddresses(c.clock().Add(-c.stale)) // Stale addresses may still be used
+	c.sweepDenials(c.clock())
+	// Entries which can still be served stale are not expired yet
+	now := c.clock().Add(-c.stale)
+	zones := c.denialsByUse()
+	for c.aboveTarget() {
+		leaves := c.root.leaves(nil)
+		if len(leaves) == 0 {
+			for _, zone := range zones {
+				if !c.aboveTarget() {
+					return
+				}
+				c.evictDenial(zone)
+			}
+			c.evictAddresses()
+			return
+		}
+		// Expired leaves first, then the least recently used
+		sort.Slice(leaves, func(i, j int) bool {
+			iexpired := leaves[i].node.expired(now)
+			jexpired := leaves[j].node.expired(now)
+			if iexpired != jexpired {
+				return iexpired
+			}
+			return leaves[i].node.lastUsed < leaves[j].node.lastUsed
+		})
+		for _, l := range leaves {
+			for len(zones) > 0 && !l.node.expired(now) && c.denials[zones[0]].lastUsed < l.node.lastUsed {
+				if !c.aboveTarget() {
+					return
+				}
+				c.evictDenial(zones[0])
+				zones = zones[1:]
+			}
+			if !c.aboveTarget() {
+				return
+			}
+			l.parent.children.remove(l.node.label.Value())
+			c.entries--
+			c.bytes -= l.node.cost
+			c.evictions++
+		}
+	}
+}
+
+// The zones with proofs of non-existence, the least recently used
+// first. Must be called with the lock held.
+func (c *Cache) denialsByUse() []string {
+	zones := make([]string, 0, len(c.denials))
+	for zone := range c.denials {
+		zones = append(zones, zone)
+	}
+	sort.Slice(zones, func(i, j int) bool {
+		return c.denials[zones[i]].lastUsed < c.denials[zones[j]].lastUsed
+	})
+	return zones
+}
+
+// Must be called with the lock held
+func (c *Cache) evictDenial(zone string) {
+	c.evictions += uint64(c.removeDenial(zone))
+}
+
+// The hosts which expire first go first. Must be called with the lock
+// held.
+func (c *Cache) evictAddresses() {
+	hosts := make([]string, 0, len(c.addresses))
+	for host := range c.addresses {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return c.addresses[hosts[i]].expires().Before(c.addresses[hosts[j]].expires())
+	})
+	for _, host := range hosts {
+		if !c.aboveTarget() {
+			return
+		}
+		c.removeAddresses(host)
+		c.evictions++
+	}
+}
+
+// Evictions returns the number of entries evicted since the creation
+// of the cache.
+func (c *Cache) Evictions() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.evictions
+}
+
+// Size returns the number of entries in the cache and the
+// approximation of the memory they use.
+func (c *Cache) Size() (entries int, bytes int) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.entries, c.bytes
+}
@@ -0,0 +1,108 @@
+package dnscache
+
+import (
+	// Standard packages
+	"fmt"
+	"testing"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+func TestEvictLeastRecentlyUsed(me *testing.T) {
+	clock := &fakeClock{}
+	cache := New(Options{Clock: clock.Now, MaxEntries: 20})
+	cache.Put("lru.example", []string{"ns.lru.example"}, defaultTTL)
+	cache.Put("www.lru.example", []string{}, defaultTTL)
+	for i := 0; i < 50; i++ {
+		clock.advance(1)
+		cache.Get("www.lru.example", defaultQtype) // Keep it fresh
+		cache.PutNx(fmt.Sprintf("random%d.lru.example", i), defaultTTL)
+	}
+	entries, _ := cache.Size()
+	if entries > 20 {
+		me.Fatalf("%d entries, more than the limit", entries)
+	}
+	if cache.Evictions() == 0 {
+		me.Fatal("Nothing evicted")
+	}
+	ok, _, _ := cache.Get("www.lru.example", defaultQtype)
+	if ok.Exists == nil {
+		me.Fatal("A recently used entry was evicted")
+	}
+	ok, _, _ = cache.Get("random0.lru.example", defaultQtype)
+	if ok.Exists != nil {
+		me.Fatal("The least recently used entry was not evicted")
+	}
+	ok, _, _ = cache.Get("random49.lru.example", defaultQtype)
+	if ok.Exists == nil {
+		me.Fatal("The last entry was evicted")
+	}
+	// The zone cut has children so it must stay
+	ok, result, _ := cache.Get("lru.example", defaultQtype)
+	if ok.Exists == nil || len(result) != 1 {
+		me.Fatal("A zone with children was evicted")
+	}
+}
+
+func TestEvictParentsLast(me *testing.T) {
+	clock := &fakeClock{}
+	cache := New(Options{Clock: clock.Now, MaxEntries: 5})
+	cache.Put("deep.example", []string{"ns.deep.example"}, defaultTTL)
+	clock.advance(1)
+	cache.PutNx("a.b.c.d.deep.example", defaultTTL) // One node too many
+	// Intermediate nodes are not evicted before their children
+	if cache.root.find(cache.labels("a.b.c.d.deep.example")) != nil {
+		me.Fatal("The leaf was not evicted")
+	}
+	if cache.root.find(cache.labels("b.c.d.deep.example")) == nil {
+		me.Fatal("The parent was evicted before its child")
+	}
+	clock.advance(1)
+	cache.PutNx("other.example", defaultTTL)
+	entries, _ := cache.Size()
+	if entries > 5 {
+		me.Fatalf("%d entries, more than the limit", entries)
+	}
+	// Every surviving node is still attached to its parent, and
+	// counted
+	var walk func(t *tree) int
+	walk = func(t *tree) int {
+		nodes := 1
+		t.children.each(func(child *tree) {
+			if child.parent != t {
+				me.Fatalf("%s is not attached to its parent", child.name())
+			}
+			nodes += walk(child)
+		})
+		return nodes
+	}
+	if nodes := walk(&cache.root) - 1; nodes != entries {
+		me.Fatalf("%d nodes in the tree, %d counted", nodes, entries)
+	}
+}
+
+func TestEvictBytes(me *testing.T) {
+	cache := New(Options{MaxBytes: 20000})
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("host%d.bytes.example", i)
+		cache.PutRRset(name, defaultQtype, []dns.RR{mustRR(name + " 300 IN A 192.0.2.1")})
+	}
+	entries, bytes := cache.Size()
+	if bytes > 20000 {
+		me.Fatalf("%d bytes, more than the limit", bytes)
+	}
+	if entries == 0 || cache.Evictions() == 0 {
+		me.Fail()
+	}
+}
+
+func TestNoLimit(me *testing.T) {
+	cache := New(Options{})
+	for i := 0; i < 1000; i++ {
+		cache.PutNx(fmt.Sprintf("nx%d.flood.example", i), defaultTTL)
+	}
+	entries, _ := cache.Size()
+	if entries != 1002 || cache.Evictions() != 0 {
+		me.Fatalf("%d entries, %d evictions", entries, cache.Evictions())
+	}
+}
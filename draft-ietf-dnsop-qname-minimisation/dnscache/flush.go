@@ -0,0 +1,125 @@
+package dnscache
+
+// Removal of entries, for instance when an operator wants to purge a
+// broken delegation.
+
+import (
+	// Standard packages
+	"time"
+)
+
+// Number of nodes of the subtree, and their approximate memory use
+func (t *tree) weight() (nodes int, bytes int) {
+	nodes, bytes = 1, t.cost
+	t.children.each(func(child *tree) {
+		n, b := child.weight()
+		nodes += n
+		bytes += b
+	})
+	return nodes, bytes
+}
+
+// Must be called with the lock held. Forgets the NSEC and NSEC3
+// records of the zones and the addresses of the hosts which are name
+// or, with subtree, below it. Returns the number of entries forgotten.
+func (c *Cache) forget(labels []string, subtree bool) (removed int) {
+	matches := func(key string) bool {
+		keyLabels := c.labels(key)
+		if subtree {
+			return keyLabels != nil && below(keyLabels, labels)
+		}
+		return keyLabels != nil && len(keyLabels) == len(labels) && below(keyLabels, labels)
+	}
+	for zone := range c.denials {
+		if matches(zone) {
+			removed += c.removeDenial(zone)
+		}
+	}
+	for host := range c.addresses {
+		if matches(host) {
+			c.removeAddresses(host)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Delete forgets everything about name: name servers, non-existence,
+// answers, and the NSEC records and addresses stored under this name.
+// What we know about the names below is kept. Returns false if the
+// name was not in the cache.
+func (c *Cache) Delete(name string) bool {
+	labels := c.labels(name)
+	if len(labels) == 0 { // Invalid, or the root, which we never forget
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.forget(labels, false)
+	parent := c.root.find(labels[:len(labels)-1])
+	if parent == nil {
+		return false
+	}
+	node, ok := parent.children.get(labels[len(labels)-1])
+	if !ok {
+		return false
+	}
+	if node.children.len() == 0 {
+		parent.children.remove(node.label.Value())
+		c.entries--
+		c.bytes -= node.cost
+		return true
+	}
+	// Like a node created only as the parent of another one
+	node.exists = true
+	node.nameservers = nil
+	node.source = ""
+	node.zone = ""
+	node.ttl = 0
+	node.expires = time.Time{}
+	node.data = nil
+	c.bytes += node.resize()
+	return true
+}
+
+// FlushBelow forgets name and everything below it. Get will then
+// return, for these names, the closest zone above name. Flushing the
+// root empties the cache, except for the root name servers. Returns the
+// number of entries removed, see Options.MaxEntries.
+func (c *Cache) FlushBelow(name string) int {
+	labels := c.labels(name)
+	if labels == nil {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	forgotten := c.forget(labels, true)
+	if len(labels) == 0 {
+		removed := forgotten + c.entries
+		c.root.children = children{}
+		c.entries = 0
+		c.bytes = c.root.cost
+		return removed
+	}
+	parent := c.root.find(labels[:len(labels)-1])
+	if parent == nil {
+		return forgotten
+	}
+	node, ok := parent.children.get(labels[len(labels)-1])
+	if !ok {
+		return forgotten
+	}
+	nodes, bytes := node.weight()
+	parent.children.remove(node.label.Value())
+	c.entries -= nodes
+	c.bytes -= bytes
+	return forgotten + nodes
+}
+
+func Delete(name string) bool {
+	return Default.Delete(name)
+}
+
+func FlushBelow(name string) int {
+	return Default.FlushBelow(name)
+}
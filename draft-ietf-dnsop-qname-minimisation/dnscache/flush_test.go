@@ -0,0 +1,103 @@
+package dnscache
+
+import (
+	// Standard packages
+	"testing"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+func populateForFlush() *Cache {
+	cache := New(Options{})
+	cache.Put("example", []string{"ns.nic.example"}, 600)
+	cache.Put("broken.example", []string{"ns.broken.example"}, 600)
+	cache.Put("sub.broken.example", []string{"ns.sub.broken.example"}, 600)
+	cache.PutRRset("www.sub.broken.example", dns.TypeA, []dns.RR{mustRR("www.sub.broken.example. 300 IN A 192.0.2.1")})
+	cache.PutAddresses("ns.broken.example", []dns.RR{mustRR("ns.broken.example. 300 IN A 192.0.2.53")})
+	cache.PutAddresses("ns.nic.example", []dns.RR{mustRR("ns.nic.example. 300 IN A 192.0.2.54")})
+	cache.PutNx("nx.example", 300)
+	return cache
+}
+
+func TestFlushBelow(me *testing.T) {
+	cache := populateForFlush()
+	before, bytesBefore := cache.Size()
+	// Three nodes and the addresses of ns.broken.example
+	if removed := cache.FlushBelow("Broken.Example."); removed != 4 {
+		me.Fatalf("%d entries removed instead of 4", removed)
+	}
+	after, bytesAfter := cache.Size()
+	if after != before-4 || bytesAfter >= bytesBefore {
+		me.Fatal("Size not updated")
+	}
+	for _, name := range []string{"broken.example", "sub.broken.example", "www.sub.broken.example"} {
+		ok, _, records := cache.Get(name, dns.TypeA)
+		if ok.Exists != nil || records != nil || ok.Closest != "example" {
+			me.Fatalf("Flushed name %s still known (closest \"%s\")", name, ok.Closest)
+		}
+	}
+	if cache.Addresses("ns.broken.example") != nil || cache.Addresses("ns.nic.example") == nil {
+		me.Fatal("Wrong addresses flushed")
+	}
+	if ok, _, _ := cache.Get("nx.example", dns.TypeA); ok.Exists == nil || *ok.Exists {
+		me.Fatal("Name outside of the subtree flushed")
+	}
+	if cache.FlushBelow("unknown.example") != 0 || cache.FlushBelow("a..example") != 0 {
+		me.Fatal("Flush of unknown names")
+	}
+}
+
+func TestFlushRoot(me *testing.T) {
+	cache := populateForFlush()
+	cache.FlushBelow(".")
+	if entries, bytes := cache.Size(); entries != 0 || bytes != 0 {
+		me.Fatal("Cache not empty")
+	}
+	ok, nameservers, _ := cache.Get("www.example", dns.TypeA)
+	if ok.Exists != nil || ok.Closest != "" || len(nameservers) != 0 {
+		me.Fatal("Wrong reply after a flush")
+	}
+	if _, nameservers, _ = cache.Get("", dns.TypeNS); len(nameservers) != 13 {
+		me.Fatal("Root name servers flushed")
+	}
+}
+
+func TestDelete(me *testing.T) {
+	cache := populateForFlush()
+	before, _ := cache.Size()
+	// The delegation disappears but what is below stays
+	if !cache.Delete("broken.example") {
+		me.Fatal("Delete failed")
+	}
+	if entries, _ := cache.Size(); entries != before {
+		me.Fatal("Node with children removed")
+	}
+	ok, _, _ := cache.Get("other.broken.example", dns.TypeA)
+	if ok.Closest != "example" {
+		me.Fatalf("Deleted zone cut still used (closest \"%s\")", ok.Closest)
+	}
+	ok, _, _ = cache.Get("www.sub.broken.example", dns.TypeA)
+	if ok.Closest != "sub.broken.example" || ok.Exists == nil {
+		me.Fatal("Names below deleted")
+	}
+	if cache.Addresses("ns.broken.example") == nil {
+		me.Fatal("Addresses of another name deleted")
+	}
+	// A leaf is removed
+	if !cache.Delete("nx.example") {
+		me.Fatal("Delete failed")
+	}
+	if entries, _ := cache.Size(); entries != before-1 {
+		me.Fatal("Leaf not removed")
+	}
+	if ok, _, _ := cache.Get("nx.example", dns.TypeA); ok.Exists != nil {
+		me.Fatal("Deleted name still known")
+	}
+	cache.Delete("ns.nic.example")
+	if cache.Addresses("ns.nic.example") != nil {
+		me.Fatal("Addresses not deleted")
+	}
+	if cache.Delete("unknown.example") || cache.Delete(".") {
+		me.Fatal("Delete of an unknown name or of the root")
+	}
+}
@@ -0,0 +1,144 @@
+package dnscache
+
+// Root hints: the names and addresses of the root name servers, in the
+// format of the named.root file published by IANA
+// <https://www.internic.net/domain/named.root>, which is a zone file.
+
+import (
+	// Standard packages
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+type Hints struct {
+	Servers   []string            // Names of the root name servers, without the final dot
+	Addresses map[string][]net.IP // Of the root name servers, indexed by their names
+}
+
+var ErrNoHints = errors.New("No NS records for the root in the hints")
+
+// Used when Options.Hints is nil
+const builtinHints = `
+.                        3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
+.                        3600000      NS    B.ROOT-SERVERS.NET.
+B.ROOT-SERVERS.NET.      3600000      A     170.247.170.2
+B.ROOT-SERVERS.NET.      3600000      AAAA  2801:1b8:10::b
+.                        3600000      NS    C.ROOT-SERVERS.NET.
+C.ROOT-SERVERS.NET.      3600000      A     192.33.4.12
+C.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:2::c
+.                        3600000      NS    D.ROOT-SERVERS.NET.
+D.ROOT-SERVERS.NET.      3600000      A     199.7.91.13
+D.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:2d::d
+.                        3600000      NS    E.ROOT-SERVERS.NET.
+E.ROOT-SERVERS.NET.      3600000      A     192.203.230.10
+E.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:a8::e
+.                        3600000      NS    F.ROOT-SERVERS.NET.
+F.ROOT-SERVERS.NET.      3600000      A     192.5.5.241
+F.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:2f::f
+.                        3600000      NS    G.ROOT-SERVERS.NET.
+G.ROOT-SERVERS.NET.      3600000      A     192.112.36.4
+G.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:12::d0d
+.                        3600000      NS    H.ROOT-SERVERS.NET.
+H.ROOT-SERVERS.NET.      3600000      A     198.97.190.53
+H.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:1::53
+.                        3600000      NS    I.ROOT-SERVERS.NET.
+I.ROOT-SERVERS.NET.      3600000      A     192.36.148.17
+I.ROOT-SERVERS.NET.      3600000      AAAA  2001:7fe::53
+.                        3600000      NS    J.ROOT-SERVERS.NET.
+J.ROOT-SERVERS.NET.      3600000      A     192.58.128.30
+J.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:c27::2:30
+.                        3600000      NS    K.ROOT-SERVERS.NET.
+K.ROOT-SERVERS.NET.      3600000      A     193.0.14.129
+K.ROOT-SERVERS.NET.      3600000      AAAA  2001:7fd::1
+.                        3600000      NS    L.ROOT-SERVERS.NET.
+L.ROOT-SERVERS.NET.      3600000      A     199.7.83.42
+L.ROOT-SERVERS.NET.      3600000      AAAA  2001:500:9f::42
+.                        3600000      NS    M.ROOT-SERVERS.NET.
+M.ROOT-SERVERS.NET.      3600000      A     202.12.27.33
+M.ROOT-SERVERS.NET.      3600000      AAAA  2001:dc3::35
+`
+
+// ReadHints parses root hints in the zone file format. Only the NS
+// records of the root and the A and AAAA records of these name
+// servers are used, the rest is ignored.
+func ReadHints(r io.Reader) (*Hints, error) {
+	hints := &Hints{Addresses: map[string][]net.IP{}}
+	addresses := map[string][]net.IP{}
+	parser := dns.NewZoneParser(r, ".", "")
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		switch rr := rr.(type) {
+		case *dns.NS:
+			if rr.Hdr.Name == "." {
+				hints.Servers = append(hints.Servers, zoneKey(rr.Ns))
+			}
+		case *dns.A:
+			addresses[zoneKey(rr.Hdr.Name)] = append(addresses[zoneKey(rr.Hdr.Name)], rr.A)
+		case *dns.AAAA:
+			addresses[zoneKey(rr.Hdr.Name)] = append(addresses[zoneKey(rr.Hdr.Name)], rr.AAAA)
+		}
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	if len(hints.Servers) == 0 {
+		return nil, ErrNoHints
+	}
+	for _, server := range hints.Servers {
+		if addresses[server] != nil {
+			hints.Addresses[server] = addresses[server]
+		}
+	}
+	return hints, nil
+}
+
+// LoadHints reads root hints from a file, typically named.root.
+func LoadHints(filename string) (*Hints, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadHints(f)
+}
+
+// DefaultHints returns the hints used when Options.Hints is nil. They
+// must not be modified.
+func DefaultHints() *Hints {
+	return defaultHints
+}
+
+var defaultHints = mustReadHints(builtinHints)
+
+func mustReadHints(text string) *Hints {
+	hints, err := ReadHints(strings.NewReader(text))
+	if err != nil {
+		panic(err)
+	}
+	return hints
+}
+
+// PutRoot replaces the name servers of the root, typically with the
+// answer to a priming query (RFC 8109). Unlike the other entries, they
+// do not expire: it is up to the caller to prime again after ttl
+// seconds, and, until then, the old set is better than nothing. The
+// addresses are given with PutAddresses.
+func (c *Cache) PutRoot(ns []string, ttl uint32) {
+	if len(ns) == 0 {
+		return
+	}
+	servers := make([]string, len(ns))
+	for i := range ns {
+		servers[i] = zoneKey(ns[i])
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.root.nameservers = &servers
+	c.root.ttl = ttl
+}
@@ -0,0 +1,103 @@
+package dnscache
+
+import (
+	// Standard packages
+	"strings"
+	"testing"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+const testHints = `;       This file holds the information on root name servers needed to
+;       initialize cache of Internet domain name servers
+;
+.                        3600000      NS    NS1.TEST-ROOT.
+NS1.TEST-ROOT.           3600000      A     127.0.0.1
+NS1.TEST-ROOT.           3600000      AAAA  ::1
+;
+.                        3600000      NS    ns2.test-root.
+ns2.test-root.           3600000      A     127.0.0.2
+other.test-root.         3600000      A     127.0.0.3
+; End of file`
+
+func TestReadHints(me *testing.T) {
+	hints, err := ReadHints(strings.NewReader(testHints))
+	if err != nil {
+		me.Fatalf("Cannot read the hints: %s", err)
+	}
+	if len(hints.Servers) != 2 || hints.Servers[0] != "ns1.test-root" || hints.Servers[1] != "ns2.test-root" {
+		me.Fatalf("Wrong servers %v", hints.Servers)
+	}
+	if len(hints.Addresses) != 2 || len(hints.Addresses["ns1.test-root"]) != 2 ||
+		hints.Addresses["ns2.test-root"][0].String() != "127.0.0.2" {
+		me.Fatalf("Wrong addresses %v", hints.Addresses)
+	}
+}
+
+func TestBadHints(me *testing.T) {
+	_, err := ReadHints(strings.NewReader("ns1.test-root. 3600000 A 127.0.0.1\n"))
+	if err != ErrNoHints {
+		me.Fatal("Hints without NS accepted")
+	}
+	_, err = ReadHints(strings.NewReader(". 3600000 NS a.test-root.\na.test-root. 3600000 A 127.0.0.300\n"))
+	if err == nil {
+		me.Fatal("Invalid zone file accepted")
+	}
+}
+
+func TestDefaultHints(me *testing.T) {
+	hints := DefaultHints()
+	if len(hints.Servers) != 13 || len(hints.Addresses) != 13 {
+		me.Fatal("Wrong builtin hints")
+	}
+	cache := New(Options{})
+	_, nameservers, _ := cache.Get("", dns.TypeNS)
+	if len(nameservers) != 13 || nameservers[0] != "a.root-servers.net" {
+		me.Fatalf("Wrong root name servers %v", nameservers)
+	}
+	if len(cache.Addresses("k.root-servers.net.")) != 2 {
+		me.Fatal("No addresses for the root name servers")
+	}
+}
+
+func TestCacheWithHints(me *testing.T) {
+	hints, err := ReadHints(strings.NewReader(testHints))
+	if err != nil {
+		me.Fatalf("Cannot read the hints: %s", err)
+	}
+	clock := &fakeClock{}
+	cache := New(Options{Hints: hints, Clock: clock.Now})
+	reply, nameservers, _ := cache.Get("", dns.TypeNS)
+	if len(nameservers) != 2 || len(reply.Addresses["ns1.test-root"]) != 2 {
+		me.Fatalf("Hints not used: %v %v", nameservers, reply.Addresses)
+	}
+	// Addresses learned later take precedence, and the hints come back
+	// when they expire
+	cache.PutAddresses("ns2.test-root", []dns.RR{mustRR("ns2.test-root. 60 IN A 192.0.2.2")})
+	if addresses := cache.Addresses("ns2.test-root"); len(addresses) != 1 || addresses[0].String() != "192.0.2.2" {
+		me.Fatal("Learned addresses not used")
+	}
+	clock.advance(61)
+	if addresses := cache.Addresses("ns2.test-root"); len(addresses) != 1 || addresses[0].String() != "127.0.0.2" {
+		me.Fatal("Hints not used after expiration")
+	}
+}
+
+func TestPutRoot(me *testing.T) {
+	clock := &fakeClock{}
+	cache := New(Options{Clock: clock.Now})
+	cache.PutRoot([]string{"NS1.test-root.", "ns2.test-root."}, 518400)
+	cache.PutAddresses("ns1.test-root.", []dns.RR{mustRR("ns1.test-root. 518400 IN A 192.0.2.1")})
+	clock.advance(600000)
+	reply, nameservers, _ := cache.Get("", dns.TypeNS)
+	if len(nameservers) != 2 || nameservers[0] != "ns1.test-root" {
+		me.Fatalf("Root name servers not replaced: %v", nameservers)
+	}
+	if len(reply.Addresses) != 0 {
+		me.Fatal("Addresses of the root name servers did not expire")
+	}
+	cache.PutRoot(nil, 0)
+	if _, nameservers, _ = cache.Get("", dns.TypeNS); len(nameservers) != 2 {
+		me.Fatal("Root name servers removed")
+	}
+}
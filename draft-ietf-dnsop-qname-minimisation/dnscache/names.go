@@ -0,0 +1,115 @@
+package dnscache
+
+// Parsing of domain names. The tree is indexed by labels, which may
+// contain any byte: an escaped dot (\.) is not a label separator and
+// \DDD is the same as the byte it stands for. Case-insensitivity is
+// for ASCII only (RFC 4343).
+
+import (
+	// Standard packages
+	"fmt"
+	"strings"
+	"unicode/utf8"
+	// External packages
+	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
+)
+
+// For Options.IDNA. Less strict than idna.Lookup, since names like
+// _dmarc.example are common in the DNS.
+var idnaProfile = idna.New(idna.MapForLookup(), idna.StrictDomainName(false))
+
+// Returns the labels of a domain name, from the rightmost one, in wire
+// format (escapes resolved) and lower case, as needed for the
+// canonical order of RFC 4034, section 6.1. nil if the name is
+// invalid.
+func canonicalLabels(name string) [][]byte {
+	buf := make([]byte, 256)
+	off, err := dns.PackDomainName(dns.Fqdn(name), buf, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+	labels := [][]byte{}
+	for i := 0; i < off && buf[i] != 0; i += int(buf[i]) + 1 {
+		label := buf[i+1 : i+1+int(buf[i])]
+		for j := range label { // DNS is case-insensitive for ASCII only
+			if label[j] >= 'A' && label[j] <= 'Z' {
+				label[j] += 'a' - 'A'
+			}
+		}
+		labels = append([][]byte{label}, labels...)
+	}
+	return labels
+}
+
+// The label in presentation format, with only the escapes which are
+// needed, so that the same label always gives the same string
+func labelString(label []byte) string {
+	var result strings.Builder
+	for _, b := range label {
+		switch {
+		case b == '.' || b == '\\' || b == '"' || b == '(' || b == ')' || b == ';' || b == '@' || b == '$':
+			result.WriteByte('\\')
+			result.WriteByte(b)
+		case b < '!' || b > '~':
+			fmt.Fprintf(&result, "\\%03d", b)
+		default:
+			result.WriteByte(b)
+		}
+	}
+	return result.String()
+}
+
+// Returns the labels of the name, from the rightmost one, as used
+// for the children of the tree, so that all the spellings of a name
+// give the same labels. With Options.IDNA, U-labels are converted to
+// A-labels. nil if the name is invalid, empty for the root.
+func (c *Cache) labels(name string) []string {
+	wire := canonicalLabels(name)
+	if wire == nil {
+		return nil
+	}
+	labels := make([]string, len(wire))
+	for i, label := range wire {
+		if c.idna && utf8.Valid(label) && !ascii(label) {
+			alabel, err := idnaProfile.ToASCII(string(label))
+			if err == nil { // Otherwise, we keep the raw bytes
+				label = []byte(alabel)
+			}
+		}
+		labels[i] = labelString(label)
+	}
+	return labels
+}
+
+func ascii(label []byte) bool {
+	for _, b := range label {
+		if b >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// The name, without the trailing dot, from the labels returned by labels
+func labelsName(labels []string) string {
+	result := make([]string, len(labels))
+	for i := range labels {
+		result[len(labels)-1-i] = labels[i]
+	}
+	return strings.Join(result, ".")
+}
+
+// The key of the maps indexed by names (zones, name servers), which do
+// not use Options.IDNA since these names come from DNS messages.
+func zoneKey(zone string) string {
+	wire := canonicalLabels(zone)
+	if wire == nil { // Invalid name, at least keep it as it is
+		return strings.TrimSuffix(zone, ".")
+	}
+	labels := make([]string, len(wire))
+	for i := range wire {
+		labels[i] = labelString(wire[i])
+	}
+	return labelsName(labels)
+}
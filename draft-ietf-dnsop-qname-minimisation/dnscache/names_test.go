@@ -0,0 +1,98 @@
+package dnscache
+
+import (
+	// Standard packages
+	"strings"
+	"testing"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+func TestLabels(me *testing.T) {
+	tests := []struct {
+		name   string
+		idna   bool
+		labels string // From the rightmost label, separated by spaces, "-" for an invalid name
+	}{
+		{"www.example.com", false, "com example www"},
+		{"www.Example.COM.", false, "com example www"},
+		{"", false, ""},
+		{".", false, ""},
+		{`a\.b.example`, false, `example a\.b`},
+		{`a\046b.example`, false, `example a\.b`},
+		{`\065BC.example`, false, "example abc"},
+		{`a\ b.example`, false, `example a\032b`},
+		{`a\@b\;c.example`, false, `example a\@b\;c`},
+		{`a\\b.example`, false, `example a\\b`},
+		{`\000.example`, false, `example \000`},
+		{"\x80.example", false, `example \128`},
+		// Case-insensitivity is for ASCII only
+		{"CAFÉ.example", false, `example caf\195\137`},
+		{"café.example", false, `example caf\195\169`},
+		{"café.example", true, "example xn--caf-dma"},
+		{"CAFÉ.example", true, "example xn--caf-dma"},
+		{"XN--CAF-DMA.example", true, "example xn--caf-dma"},
+		{"_dmarc.example", true, "example _dmarc"},
+		{"a..example", false, "-"},
+		{strings.Repeat("a", 64) + ".example", false, "-"},
+		{strings.Repeat("a", 63) + ".example", false, "example " + strings.Repeat("a", 63)},
+		{strings.Repeat("abcdefghi.", 26), false, "-"},
+	}
+	for _, test := range tests {
+		cache := New(Options{IDNA: test.idna})
+		labels := cache.labels(test.name)
+		result := strings.Join(labels, " ")
+		if labels == nil {
+			result = "-"
+		}
+		if result != test.labels {
+			me.Errorf("Labels of \"%s\" (IDNA %v): got \"%s\", expected \"%s\"", test.name, test.idna, result, test.labels)
+		}
+	}
+}
+
+func TestEscapedDot(me *testing.T) {
+	cache := New(Options{})
+	cache.Put(`a\.b.example`, []string{"ns.example"}, 600)
+	ok, _, _ := cache.Get("b.example", dns.TypeNS)
+	if ok.Exists != nil {
+		me.Fatal("Escaped dot used as a label separator")
+	}
+	ok, nameservers, _ := cache.Get(`www.A\046B.Example.`, dns.TypeA)
+	if ok.Closest != `a\.b.example` || nameservers != nil {
+		me.Fatalf("Wrong closest zone \"%s\"", ok.Closest)
+	}
+}
+
+func TestIDNA(me *testing.T) {
+	cache := New(Options{IDNA: true})
+	cache.Put("café.example", []string{"ns.example"}, 600)
+	ok, _, _ := cache.Get("xn--caf-dma.example", dns.TypeNS)
+	if ok.NotAZone == nil || *ok.NotAZone || ok.Closest != "xn--caf-dma.example" {
+		me.Fatal("U-label and A-label give different entries")
+	}
+	cache = New(Options{})
+	cache.Put("café.example", []string{"ns.example"}, 600)
+	ok, _, _ = cache.Get("xn--caf-dma.example", dns.TypeNS)
+	if ok.Exists != nil {
+		me.Fatal("IDNA conversion without the option")
+	}
+}
+
+func TestInvalidName(me *testing.T) {
+	cache := New(Options{})
+	cache.Put("a..example", []string{"ns.example"}, 600)
+	if entries, _ := cache.Size(); entries != 0 {
+		me.Fatal("Invalid name stored")
+	}
+	ok, _, _ := cache.Get("a..example", dns.TypeA)
+	if ok.Exists != nil {
+		me.Fatal("Invalid name found")
+	}
+}
+
+func TestZoneKey(me *testing.T) {
+	if zoneKey("NS1.Example.") != "ns1.example" || zoneKey(`a\046b.example`) != `a\.b.example` || zoneKey(".") != "" {
+		me.Fail()
+	}
+}
@@ -0,0 +1,467 @@
+package dnscache
+
+// Aggressive use of DNSSEC-validated cache (RFC 8198): NSEC and NSEC3
+// records learned from negative answers prove the non-existence of
+// every name in their range, so we do not need to ask.
+
+// The cache does not validate anything: it is up to the caller to Put
+// only records which were validated.
+
+import (
+	// Standard packages
+	"bytes"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+type nsecRange struct {
+	owner   [][]byte // Canonical labels, see canonicalLabels
+	next    [][]byte
+	types   []uint16
+	rr      *dns.NSEC
+	expires time.Time
+}
+
+type nsec3Record struct {
+	hash    string // Of the owner, in upper case like dns.HashName
+	next    string
+	rr      *dns.NSEC3
+	expires time.Time
+}
+
+// The NSEC3 records of a zone with the same parameters. The hash of a
+// name is computed once for all of them.
+type nsec3Chain struct {
+	algorithm  uint8
+	iterations uint16
+	salt       string
+	records    []nsec3Record // Sorted by hash
+}
+
+// The proofs of non-existence of a zone
+type denial struct {
+	lastUsed int64         // Unix time, accessed atomically, see tree.touch
+	nsec     []nsecRange   // Sorted in canonical order of the owner names
+	nsec3    []*nsec3Chain // Usually one, two when the zone changes its parameters
+}
+
+const (
+	proofOverhead = 100 // Rough size of a NSEC or NSEC3 record, besides its wire size
+	// Minimum number of records before we look for expired ones
+	proofSweep = 64
+	// Above, the records are ignored: each Get would hash the name
+	// too many times (RFC 9276, section 3.2)
+	maxNSEC3Iterations = 150
+)
+
+func proofSize(rr dns.RR) int {
+	return proofOverhead + dns.Len(rr)
+}
+
+func (d *denial) touch(now time.Time) {
+	if atomic.LoadInt64(&d.lastUsed) != now.Unix() {
+		atomic.StoreInt64(&d.lastUsed, now.Unix())
+	}
+}
+
+func (d *denial) empty() bool {
+	return len(d.nsec) == 0 && len(d.nsec3) == 0
+}
+
+// Canonical order of RFC 4034, section 6.1
+func compareLabels(a, b [][]byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := bytes.Compare(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+// canonicalCompare compares two domain names in the canonical order of
+// RFC 4034, section 6.1. The result is negative if a comes before b,
+// 0 if they are equal and positive otherwise.
+func canonicalCompare(a, b string) int {
+	return compareLabels(canonicalLabels(a), canonicalLabels(b))
+}
+
+// Number of labels in common, from the right
+func commonLabels(a, b [][]byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && bytes.Equal(a[n], b[n]) {
+		n++
+	}
+	return n
+}
+
+// True if a is b or is below b
+func isBelow(a, b [][]byte) bool {
+	return len(a) >= len(b) && commonLabels(a, b) == len(b)
+}
+
+func hasType(types []uint16, qtype uint16) bool {
+	for _, t := range types {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// Must be called with the lock held
+func (c *Cache) denialOf(zone string, now time.Time) *denial {
+	if c.proofs >= c.proofSweep {
+		c.sweepDenials(now)
+	}
+	d, ok := c.denials[zoneKey(zone)]
+	if !ok {
+		d = &denial{lastUsed: now.Unix()}
+		c.denials[zoneKey(zone)] = d
+	}
+	return d
+}
+
+// Must be called with the lock held, after a record was added or
+// replaced
+func (c *Cache) proofAdded(added bool, delta int) {
+	if added {
+		c.proofs++
+		c.entries++
+	}
+	c.bytes += delta
+	if c.full() {
+		c.evict()
+	}
+}
+
+// Must be called with the lock held
+func (c *Cache) removeDenial(zone string) (removed int) {
+	d, ok := c.denials[zone]
+	if !ok {
+		return 0
+	}
+	for _, r := range d.nsec {
+		c.bytes -= proofSize(r.rr)
+	}
+	removed = len(d.nsec)
+	for _, chain := range d.nsec3 {
+		for _, r := range chain.records {
+			c.bytes -= proofSize(r.rr)
+		}
+		removed += len(chain.records)
+	}
+	delete(c.denials, zone)
+	c.proofs -= removed
+	c.entries -= removed
+	return removed
+}
+
+// Removes the expired records. Called when their number doubled since
+// the last time, so the cost is amortized over the insertions. Must be
+// called with the lock held.
+func (c *Cache) sweepDenials(now time.Time) {
+	removed := 0
+	for zone, d := range c.denials {
+		ranges := d.nsec[:0]
+		for _, r := range d.nsec {
+			if now.Before(r.expires) {
+				ranges = append(ranges, r)
+			} else {
+				c.bytes -= proofSize(r.rr)
+				removed++
+			}
+		}
+		d.nsec = ranges
+		chains := d.nsec3[:0]
+		for _, chain := range d.nsec3 {
+			records := chain.records[:0]
+			for _, r := range chain.records {
+				if now.Before(r.expires) {
+					records = append(records, r)
+				} else {
+					c.bytes -= proofSize(r.rr)
+					removed++
+				}
+			}
+			chain.records = records
+			if len(records) > 0 {
+				chains = append(chains, chain)
+			}
+		}
+		d.nsec3 = chains
+		if d.empty() {
+			delete(c.denials, zone)
+		}
+	}
+	c.proofs -= removed
+	c.entries -= removed
+	c.proofSweep = 2 * c.proofs
+	if c.proofSweep < proofSweep {
+		c.proofSweep = proofSweep
+	}
+}
+
+// PutNSEC records a validated NSEC record of zone. It is used for its
+// TTL.
+func (c *Cache) PutNSEC(zone string, rr *dns.NSEC) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.clock()
+	c.putNSEC(zone, rr, now.Add(time.Duration(rr.Hdr.Ttl)*time.Second), now)
+}
+
+// Must be called with the lock held
+func (c *Cache) putNSEC(zone string, rr *dns.NSEC, expires time.Time, now time.Time) {
+	owner := canonicalLabels(rr.Hdr.Name)
+	next := canonicalLabels(rr.NextDomain)
+	if owner == nil || next == nil {
+		return
+	}
+	d := c.denialOf(zone, now)
+	r := nsecRange{owner: owner, next: next, types: rr.TypeBitMap, rr: rr, expires: expires}
+	ranges := d.nsec
+	i := sort.Search(len(ranges), func(i int) bool { return compareLabels(ranges[i].owner, owner) >= 0 })
+	if i < len(ranges) && compareLabels(ranges[i].owner, owner) == 0 {
+		delta := proofSize(rr) - proofSize(ranges[i].rr)
+		ranges[i] = r
+		c.proofAdded(false, delta)
+		return
+	}
+	ranges = append(ranges, nsecRange{})
+	copy(ranges[i+1:], ranges[i:])
+	ranges[i] = r
+	d.nsec = ranges
+	c.proofAdded(true, proofSize(rr))
+}
+
+// PutNSEC3 records a validated NSEC3 record of zone. It is used for its
+// TTL.
+func (c *Cache) PutNSEC3(zone string, rr *dns.NSEC3) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.clock()
+	c.putNSEC3(zone, rr, now.Add(time.Duration(rr.Hdr.Ttl)*time.Second), now)
+}
+
+// Must be called with the lock held
+func (c *Cache) putNSEC3(zone string, rr *dns.NSEC3, expires time.Time, now time.Time) {
+	labels := dns.SplitDomainName(rr.Hdr.Name)
+	if rr.Hash != dns.SHA1 || len(labels) == 0 { // The only algorithm of RFC 5155
+		return
+	}
+	if rr.Iterations > maxNSEC3Iterations {
+		return
+	}
+	d := c.denialOf(zone, now)
+	chain := d.chain(rr.Hash, rr.Iterations, strings.ToUpper(rr.Salt))
+	r := nsec3Record{hash: strings.ToUpper(labels[0]), next: strings.ToUpper(rr.NextDomain), rr: rr, expires: expires}
+	records := chain.records
+	i := sort.Search(len(records), func(i int) bool { return records[i].hash >= r.hash })
+	if i < len(records) && records[i].hash == r.hash {
+		delta := proofSize(rr) - proofSize(records[i].rr)
+		records[i] = r
+		c.proofAdded(false, delta)
+		return
+	}
+	records = append(records, nsec3Record{})
+	copy(records[i+1:], records[i:])
+	records[i] = r
+	chain.records = records
+	c.proofAdded(true, proofSize(rr))
+}
+
+func (d *denial) chain(algorithm uint8, iterations uint16, salt string) *nsec3Chain {
+	for _, chain := range d.nsec3 {
+		if chain.algorithm == algorithm && chain.iterations == iterations && chain.salt == salt {
+			return chain
+		}
+	}
+	chain := &nsec3Chain{algorithm: algorithm, iterations: iterations, salt: salt}
+	d.nsec3 = append(d.nsec3, chain)
+	return chain
+}
+
+// Returns the NSEC range whose owner is the closest before name (or
+// equal), nil if there is none or if it expired.
+func (d *denial) lookup(name [][]byte, now time.Time) *nsecRange {
+	i := sort.Search(len(d.nsec), func(i int) bool { return compareLabels(d.nsec[i].owner, name) > 0 })
+	if i == 0 {
+		if len(d.nsec) == 0 {
+			return nil
+		}
+		i = len(d.nsec) // Before the first owner, the last NSEC wraps around
+	}
+	r := &d.nsec[i-1]
+	if !now.Before(r.expires) {
+		return nil
+	}
+	return r
+}
+
+// Does the NSEC range cover name, without matching it?
+func (r *nsecRange) covers(name [][]byte) bool {
+	afterOwner := compareLabels(r.owner, name) < 0
+	beforeNext := compareLabels(name, r.next) < 0
+	if compareLabels(r.owner, r.next) >= 0 { // The last NSEC of the zone, next is the apex
+		return afterOwner || beforeNext
+	}
+	return afterOwner && beforeNext
+}
+
+// What the types at a name tell about qtype
+func typesProof(types []uint16, qtype uint16) (exists *bool, nodata *bool) {
+	if hasType(types, dns.TypeNS) && !hasType(types, dns.TypeSOA) && qtype != dns.TypeDS {
+		// A delegation: the parent does not know what the child has
+		return &True, nil
+	}
+	if hasType(types, qtype) || hasType(types, dns.TypeCNAME) {
+		// We do not have the data, it must be asked for
+		return &True, nil
+	}
+	return &True, &True
+}
+
+func (d *denial) nsecProof(name [][]byte, qtype uint16, now time.Time) (exists *bool, nodata *bool) {
+	r := d.lookup(name, now)
+	if r == nil {
+		return nil, nil
+	}
+	if compareLabels(r.owner, name) == 0 {
+		return typesProof(r.types, qtype)
+	}
+	if !r.covers(name) {
+		return nil, nil
+	}
+	if isBelow(name, r.owner) &&
+		((hasType(r.types, dns.TypeNS) && !hasType(r.types, dns.TypeSOA)) || hasType(r.types, dns.TypeDNAME)) {
+		// The owner is a delegation (or a DNAME): it does not
+		// tell anything about the names below
+		return nil, nil
+	}
+	if isBelow(r.next, name) { // An empty non-terminal
+		return &True, &True
+	}
+	// The closest encloser. A wildcard there could have been
+	// used, we need to prove it does not exist.
+	n := commonLabels(name, r.owner)
+	if m := commonLabels(name, r.next); m > n {
+		n = m
+	}
+	wildcard := append(append([][]byte{}, name[:n]...), []byte("*"))
+	w := d.lookup(wildcard, now)
+	if w == nil || compareLabels(w.owner, wildcard) == 0 || !w.covers(wildcard) {
+		return nil, nil
+	}
+	return &False, nil
+}
+
+func (chain *nsec3Chain) hashOf(name string) string {
+	return dns.HashName(name, chain.algorithm, chain.iterations, chain.salt)
+}
+
+// Returns the NSEC3 record whose hash is the closest before hash (or
+// equal), nil if there is none or if it expired. Like
+// denial.lookup.
+func (chain *nsec3Chain) lookup(hash string, now time.Time) *nsec3Record {
+	records := chain.records
+	i := sort.Search(len(records), func(i int) bool { return records[i].hash > hash })
+	if i == 0 {
+		if len(records) == 0 {
+			return nil
+		}
+		i = len(records)
+	}
+	r := &records[i-1]
+	if !now.Before(r.expires) {
+		return nil
+	}
+	return r
+}
+
+func (chain *nsec3Chain) match(hash string, now time.Time) *nsec3Record {
+	if r := chain.lookup(hash, now); r != nil && r.hash == hash {
+		return r
+	}
+	return nil
+}
+
+// Does the NSEC3 record cover hash, without matching it?
+func (r *nsec3Record) covers(hash string) bool {
+	if r.hash >= r.next { // The last NSEC3 of the zone
+		return r.hash < hash || hash < r.next
+	}
+	return r.hash < hash && hash < r.next
+}
+
+func (chain *nsec3Chain) covers(hash string, now time.Time) *nsec3Record {
+	if r := chain.lookup(hash, now); r != nil && r.covers(hash) {
+		return r
+	}
+	return nil
+}
+
+// RFC 5155, section 8
+func (chain *nsec3Chain) proof(zone string, name string, qtype uint16, now time.Time) (exists *bool, nodata *bool) {
+	name = dns.Fqdn(name)
+	nextCloser := chain.hashOf(name)
+	if match := chain.match(nextCloser, now); match != nil {
+		return typesProof(match.rr.TypeBitMap, qtype)
+	}
+	// Look for the closest encloser proof. Each name is hashed once,
+	// the closest encloser candidate becoming the next closer name.
+	labels := dns.SplitDomainName(name)
+	zoneLabels := dns.CountLabel(dns.Fqdn(zone))
+	for i := 1; len(labels)-i >= zoneLabels; i++ {
+		closestEncloser := dns.Fqdn(strings.Join(labels[i:], "."))
+		hash := chain.hashOf(closestEncloser)
+		if chain.match(hash, now) == nil {
+			nextCloser = hash
+			continue
+		}
+		// With opt-out, the next closer name may exist, as an
+		// unsigned delegation
+		if r := chain.covers(nextCloser, now); r == nil || r.rr.Flags&1 != 0 {
+			return nil, nil
+		}
+		if chain.covers(chain.hashOf("*."+closestEncloser), now) == nil {
+			return nil, nil
+		}
+		// The next closer name does not exist, so, neither does name
+		return &False, nil
+	}
+	return nil, nil
+}
+
+// Uses the proofs of non-existence of zone for name. Must be called
+// with the lock held.
+func (c *Cache) aggressive(zone string, name string, qtype uint16, now time.Time) (exists *bool, nodata *bool) {
+	if len(c.denials) == 0 { // Usual case, and zoneKey is not free
+		return nil, nil
+	}
+	d, ok := c.denials[zoneKey(zone)]
+	if !ok {
+		return nil, nil
+	}
+	d.touch(now)
+	if len(d.nsec) > 0 {
+		labels := canonicalLabels(name)
+		if labels == nil {
+			return nil, nil
+		}
+		exists, nodata = d.nsecProof(labels, qtype, now)
+		if exists != nil {
+			return exists, nodata
+		}
+	}
+	for _, chain := range d.nsec3 {
+		exists, nodata = chain.proof(zone, name, qtype, now)
+		if exists != nil {
+			return exists, nodata
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,226 @@
+package dnscache
+
+import (
+	// Standard packages
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+func TestCanonicalOrder(me *testing.T) {
+	// RFC 4034, section 6.1
+	ordered := []string{"example", "a.example", "yljkjljk.a.example", "Z.a.example",
+		"zABC.a.EXAMPLE", "z.example", "\\001.z.example", "*.z.example", "\\200.z.example"}
+	for i := 0; i < len(ordered)-1; i++ {
+		if canonicalCompare(ordered[i], ordered[i+1]) >= 0 {
+			me.Errorf("%s should be before %s", ordered[i], ordered[i+1])
+		}
+		if canonicalCompare(ordered[i+1], ordered[i]) <= 0 {
+			me.Errorf("%s should be after %s", ordered[i+1], ordered[i])
+		}
+	}
+	if canonicalCompare("WWW.Example.", "www.example") != 0 {
+		me.Error("Case or final dot matters")
+	}
+	if canonicalCompare("a\\.b.example", "a.b.example") == 0 {
+		me.Error("Escaped dot not handled")
+	}
+}
+
+func nsecCache() (*Cache, *fakeClock) {
+	cache, clock := newFakeCache()
+	cache.Put("example", []string{"ns.example"}, defaultTTL)
+	for _, nsec := range []string{
+		"example. 3600 IN NSEC a.example. NS SOA RRSIG NSEC DNSKEY",
+		"a.example. 3600 IN NSEC d.example. A RRSIG NSEC",
+		"d.example. 3600 IN NSEC sub.example. A TXT RRSIG NSEC",
+		"sub.example. 3600 IN NSEC x.y.example. NS DS RRSIG NSEC",
+		"x.y.example. 60 IN NSEC example. A RRSIG NSEC"} {
+		cache.PutNSEC("example.", mustRR(nsec).(*dns.NSEC))
+	}
+	return cache, clock
+}
+
+func TestNSECNonExistence(me *testing.T) {
+	cache, clock := nsecCache()
+	for _, name := range []string{"b.example", "www.b.example", "e.example", "zzz.example"} {
+		ok, _, _ := cache.Get(name, dns.TypeA)
+		if ok.Exists == nil || *ok.Exists {
+			me.Errorf("%s should not exist", name)
+		}
+	}
+	for _, name := range []string{"foo.sub.example", "other.test"} {
+		ok, _, _ := cache.Get(name, dns.TypeA)
+		if ok.Exists != nil {
+			me.Errorf("%s should be unknown", name)
+		}
+	}
+	// The last NSEC expires
+	clock.advance(60)
+	ok, _, _ := cache.Get("zzz.example", dns.TypeA)
+	if ok.Exists != nil {
+		me.Error("Expired NSEC used")
+	}
+	ok, _, _ = cache.Get("b.example", dns.TypeA)
+	if ok.Exists == nil || *ok.Exists {
+		me.Error("Unexpired NSEC not used")
+	}
+}
+
+func TestNSECNoData(me *testing.T) {
+	cache, _ := nsecCache()
+	ok, _, _ := cache.Get("a.example", dns.TypeTXT)
+	if ok.Exists == nil || !*ok.Exists || ok.NoData == nil || !*ok.NoData {
+		me.Error("NODATA not deduced")
+	}
+	ok, _, _ = cache.Get("a.example", dns.TypeA)
+	if ok.Exists == nil || !*ok.Exists || ok.NoData != nil {
+		me.Error("Existing type should be unknown, so that it is asked for")
+	}
+	ok, _, _ = cache.Get("y.example", dns.TypeA) // An empty non-terminal
+	if ok.Exists == nil || !*ok.Exists || ok.NoData == nil || !*ok.NoData {
+		me.Error("Empty non-terminal not deduced")
+	}
+	ok, _, _ = cache.Get("sub.example", dns.TypeA) // A delegation
+	if ok.NoData != nil {
+		me.Error("NODATA deduced from a delegation")
+	}
+}
+
+func TestNSECWildcard(me *testing.T) {
+	cache, _ := newFakeCache()
+	cache.Put("wild", []string{"ns.wild"}, defaultTTL)
+	for _, nsec := range []string{
+		"wild. 3600 IN NSEC *.wild. NS SOA RRSIG NSEC",
+		"*.wild. 3600 IN NSEC m.wild. A RRSIG NSEC",
+		"m.wild. 3600 IN NSEC wild. A RRSIG NSEC"} {
+		cache.PutNSEC("wild", mustRR(nsec).(*dns.NSEC))
+	}
+	ok, _, _ := cache.Get("b.wild", dns.TypeA)
+	if ok.Exists != nil {
+		me.Error("Non-existence deduced despite a wildcard")
+	}
+}
+
+func nsec3Cache(optOut bool) *Cache {
+	cache, _ := newFakeCache()
+	cache.Put("example", []string{"ns.example"}, defaultTTL)
+	hashes := []string{dns.HashName("example.", dns.SHA1, 0, ""), dns.HashName("a.example.", dns.SHA1, 0, "")}
+	sort.Strings(hashes)
+	flags := 0
+	if optOut {
+		flags = 1
+	}
+	for i := range hashes {
+		rr := mustRR(fmt.Sprintf("%s.example. 3600 IN NSEC3 1 %d 0 - %s A RRSIG", hashes[i], flags,
+			hashes[(i+1)%len(hashes)]))
+		cache.PutNSEC3("example", rr.(*dns.NSEC3))
+	}
+	return cache
+}
+
+func TestNSEC3NonExistence(me *testing.T) {
+	cache := nsec3Cache(false)
+	ok, _, _ := cache.Get("b.example", dns.TypeA)
+	if ok.Exists == nil || *ok.Exists {
+		me.Error("Non-existence not deduced")
+	}
+	ok, _, _ = cache.Get("a.example", dns.TypeTXT)
+	if ok.Exists == nil || !*ok.Exists || ok.NoData == nil || !*ok.NoData {
+		me.Error("NODATA not deduced")
+	}
+	ok, _, _ = cache.Get("b.other", dns.TypeA)
+	if ok.Exists != nil {
+		me.Error("NSEC3 used outside of its zone")
+	}
+}
+
+func TestNSEC3OptOut(me *testing.T) {
+	cache := nsec3Cache(true)
+	ok, _, _ := cache.Get("b.example", dns.TypeA)
+	if ok.Exists != nil {
+		me.Error("Non-existence deduced from an opt-out range")
+	}
+}
+
+func TestNSEC3Chain(me *testing.T) {
+	cache, _ := newFakeCache()
+	cache.Put("example", []string{"ns.example"}, defaultTTL)
+	names := []string{"example.", "a.example.", "b.example.", "c.b.example.", "d.example.", "www.example."}
+	// Two sets of parameters, during a change of the salt
+	for _, salt := range []string{"-", "AB12"} {
+		hashes := make([]string, len(names))
+		for i, name := range names {
+			hashes[i] = dns.HashName(name, dns.SHA1, 2, strings.Trim(salt, "-"))
+		}
+		sort.Strings(hashes)
+		for _, i := range []int{3, 0, 5, 1, 4, 2} { // Not in order
+			rr := mustRR(fmt.Sprintf("%s.example. 3600 IN NSEC3 1 0 2 %s %s A RRSIG", strings.ToLower(hashes[i]), salt,
+				hashes[(i+1)%len(hashes)]))
+			cache.PutNSEC3("example", rr.(*dns.NSEC3))
+		}
+	}
+	if entries, _ := cache.Size(); entries != 1+2*len(names) {
+		me.Fatalf("%d entries", entries)
+	}
+	for _, name := range names[1:] {
+		if ok, _, _ := cache.Get(name, dns.TypeA); ok.Exists == nil || !*ok.Exists {
+			me.Errorf("%s should exist", name)
+		}
+	}
+	for _, name := range []string{"e.example", "x.c.b.example", "y.x.www.example"} {
+		if ok, _, _ := cache.Get(name, dns.TypeA); ok.Exists == nil || *ok.Exists {
+			me.Errorf("%s should not exist", name)
+		}
+	}
+}
+
+func TestNSEC3Iterations(me *testing.T) {
+	cache, _ := newFakeCache()
+	cache.Put("example", []string{"ns.example"}, defaultTTL)
+	hash := dns.HashName("example.", dns.SHA1, 0, "")
+	for _, iterations := range []int{maxNSEC3Iterations + 1, 65535} {
+		rr := mustRR(fmt.Sprintf("%s.example. 3600 IN NSEC3 1 0 %d - %s A RRSIG", hash, iterations, hash))
+		cache.PutNSEC3("example", rr.(*dns.NSEC3))
+	}
+	if entries, _ := cache.Size(); entries != 1 || len(cache.denials) != 0 {
+		me.Fatalf("NSEC3 records with too many iterations kept (%d entries)", entries)
+	}
+	rr := mustRR(fmt.Sprintf("%s.example. 3600 IN NSEC3 1 0 %d - %s A RRSIG", hash, maxNSEC3Iterations, hash))
+	cache.PutNSEC3("example", rr.(*dns.NSEC3))
+	if entries, _ := cache.Size(); entries != 2 {
+		me.Fatal("NSEC3 record at the limit not kept")
+	}
+}
+
+func TestDenialsLimits(me *testing.T) {
+	clock := &fakeClock{}
+	cache := New(Options{Clock: clock.Now, MaxEntries: 100})
+	cache.PutNSEC("old.example", mustRR("old.example. 60 IN NSEC z.old.example. NS SOA").(*dns.NSEC))
+	clock.advance(60)
+	for i := 0; i < 200; i++ {
+		zone := fmt.Sprintf("zone%d.example", i)
+		clock.advance(1)
+		cache.Get("b."+zone, dns.TypeA)
+		cache.PutNSEC(zone, mustRR(fmt.Sprintf("%s. 3600 IN NSEC z.%s. NS SOA", zone, zone)).(*dns.NSEC))
+	}
+	if _, known := cache.denials[zoneKey("old.example")]; known {
+		me.Fatal("Expired NSEC kept")
+	}
+	entries, _ := cache.Size()
+	if entries > 100 || cache.Evictions() == 0 {
+		me.Fatalf("%d entries, more than the limit", entries)
+	}
+	if _, known := cache.denials[zoneKey("zone0.example")]; known {
+		me.Fatal("The least recently used zone was not evicted")
+	}
+	if _, known := cache.denials[zoneKey("zone199.example")]; !known {
+		me.Fatal("The last zone was evicted")
+	}
+	if removed := cache.FlushBelow("zone199.example"); removed != 1 {
+		me.Fatalf("%d entries flushed instead of 1", removed)
+	}
+}
@@ -0,0 +1,71 @@
+package dnscache
+
+// What a cached NXDOMAIN tells about the names below it. RFC 8020
+// says that nothing exists below a non-existing name but some broken
+// name servers return NXDOMAIN for ENTs (Empty Non-Terminals), names
+// which exist only because there are names below them.
+
+import (
+	// Standard packages
+	"time"
+)
+
+type NXDomainCut int
+
+const (
+	// RFC 8020: nothing exists below a non-existing name
+	NXDomainCutStrict NXDomainCut = iota
+	// Classic behaviour: an NXDOMAIN is only for this exact name
+	NXDomainCutOff
+	// Like NXDomainCutStrict, except when the NXDOMAIN came from a
+	// server known to return NXDOMAIN for ENTs
+	NXDomainCutHardened
+)
+
+// Must be called with the lock held
+func (c *Cache) denies(node *tree) bool {
+	switch c.nxCut {
+	case NXDomainCutOff:
+		return false
+	case NXDomainCutHardened:
+		return !c.brokenENT[node.source]
+	default:
+		return true
+	}
+}
+
+// If we learn something below a name we believed not to exist, the
+// server which told us so returns NXDOMAIN for ENTs. Must be called
+// with the lock held. labels are from the rightmost one.
+func (c *Cache) detectBrokenENT(labels []string, now time.Time) {
+	node := &c.root
+	for i := 0; i < len(labels)-1; i++ {
+		child, ok := node.children.get(labels[i])
+		if !ok {
+			return
+		}
+		if !child.exists && !child.expired(now) {
+			if child.source != "" {
+				c.brokenENT[child.source] = true
+			}
+			return
+		}
+		node = child
+	}
+}
+
+// MarkBrokenENT records that server returns NXDOMAIN for ENTs, so that,
+// with NXDomainCutHardened, its NXDOMAIN are only used for the exact
+// name.
+func (c *Cache) MarkBrokenENT(server string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.brokenENT[server] = true
+}
+
+// BrokenENT tells if server is known to return NXDOMAIN for ENTs.
+func (c *Cache) BrokenENT(server string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.brokenENT[server]
+}
@@ -0,0 +1,94 @@
+package dnscache
+
+import (
+	"testing"
+)
+
+func populateNx(cache *Cache) {
+	cache.Put("cut.example", []string{"ns.cut.example"}, defaultTTL)
+	cache.PutNxFrom("good.cut.example", "ns-good.example", defaultTTL)
+	cache.PutNxFrom("bad.cut.example", "ns-bad.example", defaultTTL)
+}
+
+func TestNXDomainCutStrict(me *testing.T) {
+	cache := New(Options{NXDomainCut: NXDomainCutStrict})
+	populateNx(cache)
+	cache.MarkBrokenENT("ns-bad.example")
+	for _, name := range []string{"good.cut.example", "www.good.cut.example", "www.bad.cut.example"} {
+		ok, _, _ := cache.Get(name, defaultQtype)
+		if ok.Exists == nil || *ok.Exists {
+			me.Errorf("%s should not exist", name)
+		}
+	}
+}
+
+func TestNXDomainCutOff(me *testing.T) {
+	cache := New(Options{NXDomainCut: NXDomainCutOff})
+	populateNx(cache)
+	ok, _, _ := cache.Get("good.cut.example", defaultQtype)
+	if ok.Exists == nil || *ok.Exists {
+		me.Fatal("Exact name should not exist")
+	}
+	ok, _, _ = cache.Get("www.good.cut.example", defaultQtype)
+	if ok.Exists != nil {
+		me.Fatal("Name below an NXDOMAIN should be unknown")
+	}
+	if ok.Closest != "cut.example" {
+		me.Fatalf("Wrong closest zone \"%s\"", ok.Closest)
+	}
+}
+
+func TestNXDomainCutHardened(me *testing.T) {
+	cache := New(Options{NXDomainCut: NXDomainCutHardened})
+	populateNx(cache)
+	cache.MarkBrokenENT("ns-bad.example")
+	if !cache.BrokenENT("ns-bad.example") || cache.BrokenENT("ns-good.example") {
+		me.Fatal("Broken servers not recorded")
+	}
+	ok, _, _ := cache.Get("www.good.cut.example", defaultQtype)
+	if ok.Exists == nil || *ok.Exists {
+		me.Fatal("NXDOMAIN from a good server should apply below")
+	}
+	ok, _, _ = cache.Get("www.bad.cut.example", defaultQtype)
+	if ok.Exists != nil {
+		me.Fatal("NXDOMAIN from a broken server should not apply below")
+	}
+	ok, _, _ = cache.Get("bad.cut.example", defaultQtype)
+	if ok.Exists == nil || *ok.Exists {
+		me.Fatal("NXDOMAIN from a broken server should apply to the exact name")
+	}
+	// Unknown source: we trust it
+	cache.PutNx("unknown.cut.example", defaultTTL)
+	ok, _, _ = cache.Get("www.unknown.cut.example", defaultQtype)
+	if ok.Exists == nil || *ok.Exists {
+		me.Fail()
+	}
+}
+
+func TestDetectBrokenENT(me *testing.T) {
+	cache := New(Options{NXDomainCut: NXDomainCutHardened})
+	populateNx(cache)
+	cache.PutNxFrom("ent.cut.example", "ns-liar.example", defaultTTL)
+	// We learn that there is something below
+	cache.Put("sub.ent.cut.example", []string{"ns.sub.ent.cut.example"}, defaultTTL)
+	if !cache.BrokenENT("ns-liar.example") {
+		me.Fatal("Broken server not detected")
+	}
+	ok, _, _ := cache.Get("ent.cut.example", defaultQtype)
+	if ok.Exists == nil || !*ok.Exists {
+		me.Fatal("ENT still believed not to exist")
+	}
+	ok, result, _ := cache.Get("sub.ent.cut.example", defaultQtype)
+	if ok.Exists == nil || !*ok.Exists || len(result) != 1 {
+		me.Fatal("Name below the ENT not found")
+	}
+	// Now, its other NXDOMAIN are not trusted for the names below
+	cache.PutNxFrom("other.cut.example", "ns-liar.example", defaultTTL)
+	ok, _, _ = cache.Get("www.other.cut.example", defaultQtype)
+	if ok.Exists != nil {
+		me.Fatal("NXDOMAIN from a broken server applied below")
+	}
+	if cache.BrokenENT("ns-good.example") {
+		me.Fail()
+	}
+}
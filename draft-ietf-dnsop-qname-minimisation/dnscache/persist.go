@@ -0,0 +1,377 @@
+package dnscache
+
+/* Snapshots of the cache, so a daemon does not have to learn
+everything again after a restart.
+
+The format is text, one entry per line, fields separated by a
+tabulation. The first line is "dnscache", a tabulation, and the
+version of the format, currently 1. Empty lines and lines starting
+with a semicolon are ignored. Then, each line starts with a kind and
+the name (lower case, without the final dot), followed by the
+expiration time, in seconds since the Unix epoch:
+
+ns   name  expires  ttl  nameserver nameserver ...  (a zone cut, or, without name servers, a name which is not a zone)
+nx   name  expires  ttl  [server]                   (a non-existing name, and the server which said so, if known)
+rr   name  expires  qtype  record                   (one record of an answer, in the zone file format)
+nd   name  expires  qtype                           (no data of this type, RFC 2308 NODATA)
+nsec zone  expires  qtype  record                   (a NSEC or NSEC3 record of the zone, "." for the root)
+ad   host  expires  qtype  address                  (an IPv4 or IPv6 address of a name server)
+
+Lines of an unknown kind are ignored, so new kinds can be added
+without changing the version. The root is never saved, it comes
+from the Options. */
+
+import (
+	// Standard packages
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+const (
+	snapshotMagic   = "dnscache"
+	snapshotVersion = 1
+)
+
+var ErrSnapshotVersion = errors.New("Unsupported version of the dnscache snapshot")
+
+func (t *tree) save(w io.Writer, now time.Time) error {
+	var err error
+	name := t.name()
+	if t.parent != nil && t.expires.After(now) {
+		if t.exists {
+			if t.nameservers != nil {
+				_, err = fmt.Fprintf(w, "ns\t%s\t%d\t%d\t%s\n", name, t.expires.Unix(), t.ttl,
+					strings.Join(*t.nameservers, " "))
+			}
+		} else {
+			if t.source == "" {
+				_, err = fmt.Fprintf(w, "nx\t%s\t%d\t%d\n", name, t.expires.Unix(), t.ttl)
+			} else {
+				_, err = fmt.Fprintf(w, "nx\t%s\t%d\t%d\t%s\n", name, t.expires.Unix(), t.ttl, t.source)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	qtypes := make([]int, 0, len(t.data))
+	for qtype := range t.data {
+		if t.parent != nil { // Like its name servers, the data of the root are not saved
+			qtypes = append(qtypes, int(qtype))
+		}
+	}
+	sort.Ints(qtypes)
+	for _, qtype := range qtypes {
+		set := t.data[uint16(qtype)]
+		if !set.expires.After(now) {
+			continue
+		}
+		if set.nodata {
+			_, err = fmt.Fprintf(w, "nd\t%s\t%d\t%d\n", name, set.expires.Unix(), qtype)
+			if err != nil {
+				return err
+			}
+		}
+		for _, rr := range set.records {
+			_, err = fmt.Fprintf(w, "rr\t%s\t%d\t%d\t%s\n", name, set.expires.Unix(), qtype, rr.String())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	children := make([]*tree, 0, t.children.len())
+	t.children.each(func(child *tree) {
+		children = append(children, child)
+	})
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].label.Value() < children[j].label.Value()
+	})
+	for _, child := range children {
+		err = child.save(w, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save writes a snapshot of the unexpired entries of the cache.
+func (c *Cache) Save(w io.Writer) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	out := bufio.NewWriter(w)
+	_, err := fmt.Fprintf(out, "%s\t%d\n", snapshotMagic, snapshotVersion)
+	if err != nil {
+		return err
+	}
+	now := c.clock()
+	err = c.root.save(out, now)
+	if err != nil {
+		return err
+	}
+	err = c.saveDenials(out, now)
+	if err != nil {
+		return err
+	}
+	err = c.saveAddresses(out, now)
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+func (c *Cache) saveDenials(w io.Writer, now time.Time) error {
+	zones := make([]string, 0, len(c.denials))
+	for zone := range c.denials {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	for _, zone := range zones {
+		d := c.denials[zone]
+		name := zone
+		if name == "" {
+			name = "."
+		}
+		for _, r := range d.nsec {
+			if r.expires.After(now) {
+				_, err := fmt.Fprintf(w, "nsec\t%s\t%d\t%d\t%s\n", name, r.expires.Unix(), dns.TypeNSEC, r.rr.String())
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for _, chain := range d.nsec3 {
+			for _, r := range chain.records {
+				if r.expires.After(now) {
+					_, err := fmt.Fprintf(w, "nsec\t%s\t%d\t%d\t%s\n", name, r.expires.Unix(), dns.TypeNSEC3, r.rr.String())
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Cache) saveAddresses(w io.Writer, now time.Time) error {
+	hosts := make([]string, 0, len(c.addresses))
+	for host := range c.addresses {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		for _, family := range []struct {
+			qtype uint16
+			set   addressSet
+		}{{dns.TypeA, c.addresses[host].v4}, {dns.TypeAAAA, c.addresses[host].v6}} {
+			for _, address := range family.set.valid(now) {
+				_, err := fmt.Fprintf(w, "ad\t%s\t%d\t%d\t%s\n", host, family.set.expires.Unix(), family.qtype, address)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Must be called with the lock held
+func (c *Cache) loadAddress(host string, qtype uint16, address net.IP, expires time.Time) {
+	var set addressSet
+	if old, ok := c.addresses[host]; ok {
+		if qtype == dns.TypeA {
+			set = old.v4
+		} else {
+			set = old.v6
+		}
+	}
+	if !set.expires.Equal(expires) {
+		set = addressSet{expires: expires}
+	}
+	for _, known := range set.addresses {
+		if known.Equal(address) {
+			return
+		}
+	}
+	set.addresses = append(set.addresses, address)
+	if qtype == dns.TypeA {
+		c.putAddresses(host, set, addressSet{})
+	} else {
+		c.putAddresses(host, addressSet{}, set)
+	}
+}
+
+// An answer being read, since it is spread over several lines
+type pendingRRset struct {
+	name    string
+	qtype   uint16
+	expires time.Time
+	records []dns.RR
+}
+
+func (c *Cache) flush(pending *pendingRRset) {
+	if pending.name == "" {
+		return
+	}
+	set := rrset{records: pending.records, expires: pending.expires}
+	c.put(pending.name, "", 0, func(node *tree, now time.Time) {
+		node.setData(pending.qtype, set, now)
+	})
+	*pending = pendingRRset{}
+}
+
+// Load reads a snapshot written by Save and adds its entries to the
+// cache. Entries which expired since the snapshot are ignored, the
+// others keep their remaining TTL.
+func (c *Cache) Load(r io.Reader) error {
+	in := bufio.NewScanner(r)
+	in.Buffer(make([]byte, 0, 4096), 1024*1024)
+	lineNumber := 0
+	now := c.clock()
+	pending := pendingRRset{}
+	for in.Scan() {
+		lineNumber++
+		line := in.Text()
+		if lineNumber == 1 {
+			if line != fmt.Sprintf("%s\t%d", snapshotMagic, snapshotVersion) {
+				return ErrSnapshotVersion
+			}
+			continue
+		}
+		if line == "" || line[0] == ';' {
+			continue
+		}
+		err := c.loadEntry(strings.SplitN(line, "\t", 5), now, &pending)
+		if err != nil {
+			return fmt.Errorf("Line %d of the snapshot: %s", lineNumber, err)
+		}
+	}
+	if lineNumber == 0 {
+		return ErrSnapshotVersion
+	}
+	c.flush(&pending)
+	return in.Err()
+}
+
+func (c *Cache) loadEntry(fields []string, now time.Time, pending *pendingRRset) error {
+	if len(fields) < 4 {
+		return errors.New("Not enough fields")
+	}
+	kind := fields[0]
+	name := fields[1]
+	labels := c.labels(name)
+	if labels == nil {
+		return errors.New("Invalid name")
+	}
+	switch kind {
+	case "ns", "nx", "nd", "rr", "ad":
+		if len(labels) == 0 { // Never saved, only its NSEC records are
+			return errors.New("The root")
+		}
+	}
+	seconds, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return err
+	}
+	expires := time.Unix(seconds, 0)
+	if !expires.After(now) {
+		return nil
+	}
+	switch kind {
+	case "ns", "nx":
+		ttl, err := strconv.ParseUint(fields[3], 10, 32)
+		if err != nil {
+			return err
+		}
+		nameservers := []string{}
+		source := ""
+		if kind == "ns" && len(fields) == 5 && fields[4] != "" {
+			nameservers = strings.Split(fields[4], " ")
+		}
+		if kind == "nx" && len(fields) == 5 {
+			source = fields[4]
+		}
+		c.put(name, "", 0, func(node *tree, now time.Time) {
+			node.nameservers = &nameservers
+			node.exists = kind == "ns"
+			node.source = source
+			node.ttl = uint32(ttl)
+			node.expires = expires
+			if !node.exists {
+				node.data = nil
+			}
+		})
+	case "nd":
+		qtype, err := strconv.ParseUint(fields[3], 10, 16)
+		if err != nil {
+			return err
+		}
+		c.put(name, "", 0, func(node *tree, now time.Time) {
+			node.setData(uint16(qtype), rrset{nodata: true, expires: expires}, now)
+		})
+	case "nsec":
+		if len(fields) != 5 {
+			return errors.New("No record")
+		}
+		rr, err := dns.NewRR(fields[4])
+		if err != nil {
+			return err
+		}
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			c.putNSEC(name, rr, expires, now)
+		case *dns.NSEC3:
+			c.putNSEC3(name, rr, expires, now)
+		default:
+			return errors.New("Not a NSEC or NSEC3 record")
+		}
+	case "ad":
+		if len(fields) != 5 {
+			return errors.New("No address")
+		}
+		qtype, err := strconv.ParseUint(fields[3], 10, 16)
+		if err != nil {
+			return err
+		}
+		address := net.ParseIP(fields[4])
+		if address == nil || (qtype != uint64(dns.TypeA) && qtype != uint64(dns.TypeAAAA)) {
+			return errors.New("Invalid address")
+		}
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.loadAddress(zoneKey(name), uint16(qtype), address, expires)
+	case "rr":
+		if len(fields) != 5 {
+			return errors.New("No record")
+		}
+		qtype, err := strconv.ParseUint(fields[3], 10, 16)
+		if err != nil {
+			return err
+		}
+		rr, err := dns.NewRR(fields[4])
+		if err != nil {
+			return err
+		}
+		if rr == nil {
+			return errors.New("Empty record")
+		}
+		if pending.name != name || pending.qtype != uint16(qtype) || !pending.expires.Equal(expires) {
+			c.flush(pending)
+			*pending = pendingRRset{name: name, qtype: uint16(qtype), expires: expires}
+		}
+		pending.records = append(pending.records, rr)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package dnscache
+
+import (
+	// Standard packages
+	"bytes"
+	"strings"
+	"testing"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+func TestSaveLoad(me *testing.T) {
+	cache, clock := newFakeCache()
+	cache.Put("example", []string{"a.nic.example", "b.nic.example"}, 3600)
+	cache.Put("www.example", []string{}, 3600)
+	cache.PutNx("nothere.example", 600)
+	cache.PutNx("short.example", 10)
+	cache.PutNxFrom("liar.example", "ns.liar.example", 600)
+	cache.PutNoData("www.example", dns.TypeAAAA, 600)
+	cache.PutAddresses("a.nic.example", []dns.RR{mustRR("a.nic.example. 600 IN A 192.0.2.53"),
+		mustRR("a.nic.example. 600 IN A 192.0.2.54"), mustRR("a.nic.example. 900 IN AAAA 2001:db8::53")})
+	cache.PutNSEC("example", mustRR("b.example. 600 IN NSEC d.example. A RRSIG NSEC").(*dns.NSEC))
+	cache.PutNSEC("example", mustRR("example. 600 IN NSEC b.example. NS SOA RRSIG NSEC").(*dns.NSEC))
+	cache.PutRRset("www.example", dns.TypeA, []dns.RR{mustRR("www.example. 300 IN A 192.0.2.1"),
+		mustRR("www.example. 300 IN A 192.0.2.2")})
+	txt := mustRR("www.example. 300 IN TXT \"hello\tworld\"")
+	cache.PutRRset("www.example", dns.TypeTXT, []dns.RR{txt})
+	var snapshot bytes.Buffer
+	err := cache.Save(&snapshot)
+	if err != nil {
+		me.Fatal(err)
+	}
+	if !strings.HasPrefix(snapshot.String(), "dnscache\t1\n") {
+		me.Fatalf("Wrong header in \"%s\"", snapshot.String())
+	}
+	clock.advance(100)
+	restored := New(Options{Clock: clock.Now})
+	err = restored.Load(&snapshot)
+	if err != nil {
+		me.Fatal(err)
+	}
+	ok, result, _ := restored.Get("example", defaultQtype)
+	if ok.Exists == nil || !*ok.Exists || len(result) != 2 || result[1] != "b.nic.example" {
+		me.Fatal("Zone cut not restored")
+	}
+	if len(ok.Addresses["b.nic.example"]) != 0 || len(ok.Addresses["a.nic.example"]) != 3 {
+		me.Fatal("Addresses not restored")
+	}
+	ok, result, records := restored.Get("www.example", dns.TypeA)
+	if ok.NotAZone == nil || !*ok.NotAZone || ok.Closest != "example" {
+		me.Fatal("Name which is not a zone not restored")
+	}
+	if len(records) != 2 || records[0].Header().Ttl != 200 {
+		me.Fatal("Answer not restored with its remaining TTL")
+	}
+	_, _, records = restored.Get("www.example", dns.TypeTXT)
+	txt.Header().Ttl = 200
+	if len(records) != 1 || records[0].String() != txt.String() {
+		me.Fatal("Answer with a tabulation not restored")
+	}
+	ok, _, _ = restored.Get("www.example", dns.TypeAAAA)
+	if ok.NoData == nil || !*ok.NoData {
+		me.Fatal("NODATA not restored")
+	}
+	ok, _, _ = restored.Get("c.example", defaultQtype)
+	if ok.Exists == nil || *ok.Exists {
+		me.Fatal("NSEC not restored")
+	}
+	ok, _, _ = restored.Get("foo.nothere.example", defaultQtype)
+	if ok.Exists == nil || *ok.Exists {
+		me.Fatal("NXDOMAIN not restored")
+	}
+	ok, _, _ = restored.Get("short.example", defaultQtype)
+	if ok.Exists != nil {
+		me.Fatal("Expired entry restored")
+	}
+	restored.Put("www.liar.example", []string{}, 600)
+	if !restored.BrokenENT("ns.liar.example") {
+		me.Fatal("Source of the NXDOMAIN not restored")
+	}
+	clock.advance(500)
+	ok, _, _ = restored.Get("nothere.example", defaultQtype)
+	if ok.Exists != nil {
+		me.Fatal("Restored entry did not keep its TTL")
+	}
+}
+
+func TestLoadTwice(me *testing.T) {
+	cache, clock := newFakeCache()
+	cache.PutRRset("www.example", dns.TypeA, []dns.RR{mustRR("www.example. 300 IN A 192.0.2.1")})
+	var snapshot bytes.Buffer
+	cache.Save(&snapshot)
+	restored := New(Options{Clock: clock.Now})
+	restored.Load(bytes.NewReader(snapshot.Bytes()))
+	restored.Load(bytes.NewReader(snapshot.Bytes()))
+	_, _, records := restored.Get("www.example", dns.TypeA)
+	if len(records) != 1 {
+		me.Fatalf("%d records instead of one", len(records))
+	}
+}
+
+func TestLoadErrors(me *testing.T) {
+	cache := New(Options{})
+	for _, snapshot := range []string{"", "dnscache\t2\n", "something else\n",
+		"dnscache\t1\nns\texample\n", "dnscache\t1\nnx\texample\tsoon\t10\n",
+		"dnscache\t1\nrr\texample\t99999999999\t1\tnot a record\n",
+		"dnscache\t1\nns\t.\t9999999999\t300\tns.evil\n", "dnscache\t1\nnx\t.\t9999999999\t300\n",
+		"dnscache\t1\nnd\t.\t9999999999\t6\n", "dnscache\t1\nns\t\t9999999999\t300\tns.evil\n"} {
+		if cache.Load(strings.NewReader(snapshot)) == nil {
+			me.Errorf("Snapshot \"%s\" accepted", snapshot)
+		}
+	}
+	// Comments and unknown kinds are accepted
+	err := cache.Load(strings.NewReader("dnscache\t1\n; A comment\n\nfuture\texample\t99999999999\t1\tstuff\n"))
+	if err != nil {
+		me.Fatal(err)
+	}
+}
+
+func TestSaveRoot(me *testing.T) {
+	cache := New(Options{})
+	cache.PutRRset(".", dns.TypeSOA, []dns.RR{mustRR(". 86400 IN SOA a.root-servers.net. nstld.verisign-grs.com. 1 1800 900 604800 86400")})
+	var snapshot bytes.Buffer
+	if err := cache.Save(&snapshot); err != nil {
+		me.Fatal(err)
+	}
+	if err := New(Options{}).Load(&snapshot); err != nil {
+		me.Fatalf("Snapshot with the data of the root not loaded: %s", err)
+	}
+}
+
+func TestSaveRootNSEC(me *testing.T) {
+	cache := New(Options{})
+	cache.PutNSEC(".", mustRR(". 86400 IN NSEC aaa. NS SOA RRSIG NSEC DNSKEY").(*dns.NSEC))
+	cache.PutNSEC(".", mustRR("aaa. 86400 IN NSEC . NS DS RRSIG NSEC").(*dns.NSEC))
+	var snapshot bytes.Buffer
+	if err := cache.Save(&snapshot); err != nil {
+		me.Fatal(err)
+	}
+	if !strings.Contains(snapshot.String(), "nsec\t.\t") {
+		me.Fatalf("NSEC of the root not saved: %s", snapshot.String())
+	}
+	loaded := New(Options{})
+	if err := loaded.Load(&snapshot); err != nil {
+		me.Fatalf("Snapshot with the NSEC of the root not loaded: %s", err)
+	}
+	if ok, _, _ := loaded.Get("bbb", dns.TypeA); ok.Exists == nil || *ok.Exists {
+		me.Fatal("NSEC of the root not used after a load")
+	}
+}
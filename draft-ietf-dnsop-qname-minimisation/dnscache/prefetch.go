@@ -0,0 +1,92 @@
+package dnscache
+
+// Prefetching: popular entries are refreshed before they expire, so
+// that clients do not all wait for the resolution at the same time.
+
+import (
+	// Standard packages
+	"sort"
+	"sync/atomic"
+	"time"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+// An entry which should be resolved again
+type Prefetch struct {
+	Name  string
+	Qtype uint16 // dns.TypeNS for a delegation
+	Hits  uint64 // Since the last prefetch of this name
+	TTL   uint32 // Remaining
+}
+
+// Hits since the last prefetch. The counters of a subtree decrease
+// when nodes are removed, we then count from zero.
+func since(hits uint64, prefetched uint64) uint64 {
+	if hits < prefetched {
+		return hits
+	}
+	return hits - prefetched
+}
+
+// Returns also the hits of the subtree: the name servers of a zone are
+// used by all the names below.
+func (t *tree) popular(minHits uint64, now, limit time.Time, result []Prefetch) ([]Prefetch, uint64) {
+	hits := atomic.LoadUint64(&t.hits)
+	total := hits
+	t.children.each(func(child *tree) {
+		var childHits uint64
+		result, childHits = child.popular(minHits, now, limit, result)
+		total += childHits
+	})
+	if !t.exists {
+		return result, total
+	}
+	soon := func(expires time.Time) bool {
+		return !expires.IsZero() && now.Before(expires) && expires.Before(limit)
+	}
+	// The name has to become popular again to be prefetched next time
+	zoneHits := since(total, atomic.LoadUint64(&t.zoneHits))
+	if zoneHits >= minHits && t.nameservers != nil && len(*t.nameservers) > 0 && soon(t.expires) {
+		result = append(result, Prefetch{Name: t.name(), Qtype: dns.TypeNS, Hits: zoneHits,
+			TTL: uint32(t.expires.Sub(now) / time.Second)})
+		atomic.StoreUint64(&t.zoneHits, total)
+	}
+	dataHits := since(hits, atomic.LoadUint64(&t.prefetched))
+	if dataHits < minHits {
+		return result, total
+	}
+	found := false
+	for qtype, set := range t.data {
+		if !set.nodata && soon(set.expires) {
+			result = append(result, Prefetch{Name: t.name(), Qtype: qtype, Hits: dataHits,
+				TTL: uint32(set.expires.Sub(now) / time.Second)})
+			found = true
+		}
+	}
+	if found {
+		atomic.StoreUint64(&t.prefetched, hits)
+	}
+	return result, total
+}
+
+// Popular returns the entries which were retrieved at least minHits
+// times and which will expire in less than threshold. Their hit
+// counters are reset. The most popular come first. Negative entries
+// are never returned.
+func (c *Cache) Popular(minHits uint64, threshold time.Duration) []Prefetch {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	now := c.clock()
+	result, _ := c.root.popular(minHits, now, now.Add(threshold), nil)
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Hits != result[j].Hits {
+			return result[i].Hits > result[j].Hits
+		}
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].Qtype < result[j].Qtype
+	})
+	return result
+}
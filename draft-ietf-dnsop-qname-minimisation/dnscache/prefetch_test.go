@@ -0,0 +1,80 @@
+package dnscache
+
+import (
+	// Standard packages
+	"testing"
+	"time"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+func TestPopular(me *testing.T) {
+	cache, clock := newFakeCache()
+	cache.Put("popular", []string{"a.nic.popular", "b.nic.popular"}, 600)
+	cache.Put("unpopular", []string{"a.nic.unpopular"}, 600)
+	cache.PutRRset("www.popular", dns.TypeAAAA, []dns.RR{mustRR("www.popular. 300 IN AAAA 2001:db8::1")})
+	cache.PutNoData("mail.popular", dns.TypeAAAA, 300)
+	for i := 0; i < 10; i++ {
+		cache.Get("www.popular", dns.TypeAAAA)
+		cache.Get("mail.popular", dns.TypeAAAA)
+	}
+	cache.Get("www.unpopular", dns.TypeAAAA)
+	if len(cache.Popular(5, 60*time.Second)) != 0 {
+		me.Fatal("Entries far from expiration returned")
+	}
+	clock.advance(280)
+	result := cache.Popular(5, 60*time.Second)
+	if len(result) != 1 || result[0].Name != "www.popular" || result[0].Qtype != dns.TypeAAAA ||
+		result[0].Hits != 10 || result[0].TTL != 20 {
+		me.Fatalf("Wrong entries to prefetch: %v", result)
+	}
+	// Counters were reset
+	if len(cache.Popular(5, 60*time.Second)) != 0 {
+		me.Fatal("Hit counters not reset")
+	}
+	clock.advance(300)
+	result = cache.Popular(5, 60*time.Second)
+	if len(result) != 1 || result[0].Name != "popular" || result[0].Qtype != dns.TypeNS || result[0].Hits != 20 {
+		me.Fatalf("Wrong delegation to prefetch: %v", result)
+	}
+	// Expired entries are not prefetched, they will be resolved normally
+	clock.advance(60)
+	for i := 0; i < 10; i++ {
+		cache.Get("www.popular", dns.TypeAAAA)
+	}
+	if len(cache.Popular(5, 60*time.Second)) != 0 {
+		me.Fatal("Expired entries returned")
+	}
+}
+
+func TestPopularOrder(me *testing.T) {
+	cache, clock := newFakeCache()
+	cache.Put("one", []string{"ns.one"}, 100)
+	cache.Put("two", []string{"ns.two"}, 100)
+	cache.Get("www.one", dns.TypeA)
+	cache.Get("www.two", dns.TypeA)
+	cache.Get("www.two", dns.TypeA)
+	clock.advance(90)
+	result := cache.Popular(1, 60*time.Second)
+	if len(result) != 2 || result[0].Name != "two" || result[1].Name != "one" {
+		me.Fatalf("Wrong order: %v", result)
+	}
+}
+
+func TestHitsOnLastNode(me *testing.T) {
+	cache, _ := newFakeCache()
+	cache.Put("example", []string{"ns.example"}, 600)
+	cache.PutRRset("www.example", dns.TypeA, []dns.RR{mustRR("www.example. 300 IN A 192.0.2.1")})
+	for i := 0; i < 10; i++ {
+		cache.Get("www.example", dns.TypeA)
+		cache.Get("mail.example", dns.TypeA)
+	}
+	zone := cache.root.find(cache.labels("example"))
+	www := cache.root.find(cache.labels("www.example"))
+	if zone.hits != 10 || www.hits != 10 {
+		me.Fatalf("Wrong hits: %d for the zone, %d for www", zone.hits, www.hits)
+	}
+	if _, total := cache.root.popular(1, time.Time{}, time.Time{}, nil); total != 20 {
+		me.Fatalf("%d hits in the tree", total)
+	}
+}
@@ -0,0 +1,49 @@
+package dnscache
+
+// Serving stale data (RFC 8767): when the authoritative name servers
+// do not reply, an expired answer is better than no answer at all.
+
+import (
+	// External packages
+	"github.com/miekg/dns"
+)
+
+// TTL of the stale records returned, as recommended by RFC 8767,
+// section 4
+const StaleTTL = 30
+
+// Does the reply tell us everything about the name and type?
+func complete(reply Reply) bool {
+	return reply.Exists != nil && (!*reply.Exists || reply.NoData != nil)
+}
+
+// GetStale is like Get but, if the unexpired entries are not enough,
+// also uses the ones which expired less than Options.StaleWindow
+// ago. In that case, the reply is marked Stale and the records have a
+// TTL of StaleTTL. It is meant to be used after a resolution failed.
+func (c *Cache) GetStale(name string, qtype uint16) (reply Reply, nameservers []string, records []dns.RR) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	now := c.clock()
+	reply, nameservers, records, _ = c.get(name, qtype, now)
+	if complete(reply) || c.stale == 0 {
+		return reply, nameservers, records
+	}
+	// Looking at the cache as it was StaleWindow ago shows the
+	// entries which expired since.
+	sreply, snameservers, srecords, _ := c.get(name, qtype, now.Add(-c.stale))
+	if !complete(sreply) && dns.CountLabel(dns.Fqdn(sreply.Closest)) <= dns.CountLabel(dns.Fqdn(reply.Closest)) {
+		// Nothing more than the fresh reply, not even a closer zone
+		// cut
+		return reply, nameservers, records
+	}
+	sreply.Stale = true
+	for _, rr := range srecords {
+		rr.Header().Ttl = StaleTTL
+	}
+	return sreply, snameservers, srecords
+}
+
+func GetStale(name string, qtype uint16) (reply Reply, nameservers []string, records []dns.RR) {
+	return Default.GetStale(name, qtype)
+}
@@ -0,0 +1,94 @@
+package dnscache
+
+import (
+	// Standard packages
+	"testing"
+	"time"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+func newStaleCache(window time.Duration) (*Cache, *fakeClock) {
+	clock := &fakeClock{now: time.Now().Truncate(time.Second)}
+	return New(Options{Clock: clock.Now, StaleWindow: window}), clock
+}
+
+func TestServeStale(me *testing.T) {
+	cache, clock := newStaleCache(time.Hour)
+	cache.Put("stale.example", []string{"ns.stale.example"}, 600)
+	cache.PutRRset("www.stale.example", dns.TypeA, []dns.RR{mustRR("www.stale.example. 300 IN A 192.0.2.1")})
+	cache.PutNx("nx.stale.example", 300)
+	// Fresh data is not marked stale
+	ok, _, records := cache.GetStale("www.stale.example", dns.TypeA)
+	if ok.Stale || len(records) != 1 || records[0].Header().Ttl != 300 {
+		me.Fatal("Fresh data marked stale")
+	}
+	clock.advance(900)
+	ok, _, records = cache.Get("www.stale.example", dns.TypeA)
+	if ok.NoData != nil || records != nil {
+		me.Fatal("Get returns expired data")
+	}
+	ok, _, records = cache.GetStale("www.stale.example", dns.TypeA)
+	if !ok.Stale || len(records) != 1 || records[0].Header().Ttl != StaleTTL {
+		me.Fatal("Stale data not returned")
+	}
+	if ok.Closest != "stale.example" {
+		me.Fatal("Stale delegation not used")
+	}
+	ok, _, _ = cache.GetStale("nx.stale.example", dns.TypeA)
+	if !ok.Stale || ok.Exists == nil || *ok.Exists {
+		me.Fatal("Stale NXDOMAIN not returned")
+	}
+	// Unknown, even stale
+	ok, _, _ = cache.GetStale("other.stale.example", dns.TypeA)
+	if ok.Exists != nil || !ok.Stale || ok.Closest != "stale.example" {
+		me.Fatal("Stale zone cut not returned")
+	}
+	clock.advance(3600)
+	ok, _, records = cache.GetStale("www.stale.example", dns.TypeA)
+	if ok.Stale || records != nil {
+		me.Fatal("Data too old returned")
+	}
+}
+
+func TestServeStaleDisabled(me *testing.T) {
+	cache, clock := newStaleCache(0)
+	cache.PutRRset("www.stale.example", dns.TypeA, []dns.RR{mustRR("www.stale.example. 300 IN A 192.0.2.1")})
+	clock.advance(301)
+	ok, _, records := cache.GetStale("www.stale.example", dns.TypeA)
+	if ok.Stale || records != nil {
+		me.Fail()
+	}
+}
+
+func TestStaleNotEvictedFirst(me *testing.T) {
+	clock := &fakeClock{}
+	cache := New(Options{Clock: clock.Now, StaleWindow: time.Hour, MaxEntries: 10})
+	cache.PutNx("old.example", 10)
+	clock.advance(20)
+	for i := 0; i < 9; i++ {
+		cache.Get("old.example", dns.TypeA)
+		clock.advance(1)
+		cache.PutNx(string(rune('a'+i))+".new.example", 3600)
+	}
+	ok, _, _ := cache.GetStale("old.example", dns.TypeA)
+	if !ok.Stale {
+		me.Fatal("Stale but recently used entry evicted")
+	}
+}
+
+func TestStaleAddresses(me *testing.T) {
+	cache, clock := newStaleCache(time.Hour)
+	cache.PutAddresses("ns.stale.example", []dns.RR{mustRR("ns.stale.example. 600 IN A 192.0.2.53")})
+	clock.advance(700)
+	if cache.Addresses("ns.stale.example") != nil {
+		me.Fatal("Expired addresses returned")
+	}
+	if len(cache.StaleAddresses("ns.stale.example")) != 1 {
+		me.Fatal("Stale addresses not returned")
+	}
+	clock.advance(3600)
+	if cache.StaleAddresses("ns.stale.example") != nil {
+		me.Fatal("Addresses too old returned")
+	}
+}
@@ -0,0 +1,84 @@
+package dnscache
+
+// Statistics, to know how well the cache works.
+
+import (
+	// Standard packages
+	"sync/atomic"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+type counters struct {
+	hits         uint64
+	misses       uint64
+	negativeHits uint64
+	nxCutHits    uint64
+}
+
+type Stats struct {
+	Hits         uint64 // Get found the records, or the delegation for NS
+	Misses       uint64 // Get could not give a final answer
+	NegativeHits uint64 // Get found that the name or the type does not exist
+	// Negative hits for names below a cached NXDOMAIN (RFC 8020),
+	// they are also counted in NegativeHits
+	NXDomainCutHits uint64
+	Evictions       uint64
+	Rejections      uint64 // Records out of bailiwick, or less credible than the cached ones
+	Entries         int    // Like Options.MaxEntries
+	Bytes           int    // Approximate memory use
+	// Number of nodes and of leaves by depth: index 0 is the root,
+	// 1 the TLDs, etc
+	Nodes  []int
+	Leaves []int
+}
+
+// Classifies the result of a Get
+func (c *Cache) count(qtype uint16, reply Reply, records []dns.RR, cut bool) {
+	switch {
+	case reply.Exists != nil && !*reply.Exists:
+		atomic.AddUint64(&c.counters.negativeHits, 1)
+		if cut {
+			atomic.AddUint64(&c.counters.nxCutHits, 1)
+		}
+	case reply.NoData != nil && *reply.NoData:
+		atomic.AddUint64(&c.counters.negativeHits, 1)
+	case (reply.NoData != nil && len(records) > 0) || (qtype == dns.TypeNS && reply.NotAZone != nil && !*reply.NotAZone):
+		atomic.AddUint64(&c.counters.hits, 1)
+	default:
+		atomic.AddUint64(&c.counters.misses, 1)
+	}
+}
+
+func (t *tree) census(depth int, stats *Stats) {
+	for len(stats.Nodes) <= depth {
+		stats.Nodes = append(stats.Nodes, 0)
+		stats.Leaves = append(stats.Leaves, 0)
+	}
+	stats.Nodes[depth]++
+	if t.children.len() == 0 {
+		stats.Leaves[depth]++
+	}
+	t.children.each(func(child *tree) {
+		child.census(depth+1, stats)
+	})
+}
+
+// Stats returns the counters since the creation of the cache, and the
+// current shape of the tree. It walks the whole tree.
+func (c *Cache) Stats() Stats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	stats := Stats{
+		Hits:            atomic.LoadUint64(&c.counters.hits),
+		Misses:          atomic.LoadUint64(&c.counters.misses),
+		NegativeHits:    atomic.LoadUint64(&c.counters.negativeHits),
+		NXDomainCutHits: atomic.LoadUint64(&c.counters.nxCutHits),
+		Evictions:       c.evictions,
+		Rejections:      c.rejections,
+		Entries:         c.entries,
+		Bytes:           c.bytes,
+	}
+	c.root.census(0, &stats)
+	return stats
+}
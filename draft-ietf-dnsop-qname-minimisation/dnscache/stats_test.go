@@ -0,0 +1,57 @@
+package dnscache
+
+import (
+	// Standard packages
+	"testing"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+func TestStatsCounters(me *testing.T) {
+	cache, _ := newFakeCache()
+	cache.Put("stats.example", []string{"ns.stats.example"}, 600)
+	cache.PutRRset("www.stats.example", dns.TypeA, []dns.RR{mustRR("www.stats.example. 300 IN A 192.0.2.1")})
+	cache.PutNoData("www.stats.example", dns.TypeAAAA, 300)
+	cache.PutNx("nx.stats.example", 300)
+	cache.Get("www.stats.example", dns.TypeA)      // Hit
+	cache.Get("stats.example", dns.TypeNS)         // Hit, the delegation
+	cache.Get("www.stats.example", dns.TypeAAAA)   // Negative
+	cache.Get("nx.stats.example", dns.TypeA)       // Negative
+	cache.Get("foo.nx.stats.example", dns.TypeA)   // Negative, below the NXDOMAIN
+	cache.Get("www.stats.example", dns.TypeMX)     // Miss
+	cache.Get("unknown.stats.example", dns.TypeA)  // Miss
+	cache.GetStale("www.stats.example", dns.TypeA) // Not counted
+	cache.Peek("www.stats.example", dns.TypeA)     // Not counted
+	cache.Peek("unknown.stats.example", dns.TypeA) // Not counted
+	stats := cache.Stats()
+	if stats.Hits != 2 || stats.NegativeHits != 3 || stats.NXDomainCutHits != 1 || stats.Misses != 2 {
+		me.Fatalf("Wrong counters: %+v", stats)
+	}
+}
+
+func TestStatsNXDomainCutOff(me *testing.T) {
+	cache := New(Options{NXDomainCut: NXDomainCutOff})
+	cache.PutNx("nx.stats.example", 300)
+	cache.Get("foo.nx.stats.example", dns.TypeA)
+	stats := cache.Stats()
+	if stats.NXDomainCutHits != 0 || stats.NegativeHits != 0 || stats.Misses != 1 {
+		me.Fatalf("Wrong counters: %+v", stats)
+	}
+}
+
+func TestStatsTree(me *testing.T) {
+	cache := New(Options{MaxEntries: 4})
+	cache.Put("a.example", []string{"ns.a.example"}, 600)
+	cache.Put("b.example", []string{"ns.b.example"}, 600)
+	cache.Put("www.b.example", []string{}, 600)
+	stats := cache.Stats()
+	if stats.Entries != 4 || len(stats.Nodes) != 4 ||
+		stats.Nodes[0] != 1 || stats.Nodes[1] != 1 || stats.Nodes[2] != 2 || stats.Nodes[3] != 1 ||
+		stats.Leaves[0] != 0 || stats.Leaves[1] != 0 || stats.Leaves[2] != 1 || stats.Leaves[3] != 1 {
+		me.Fatalf("Wrong shape: %+v", stats)
+	}
+	cache.Put("c.example", []string{"ns.c.example"}, 600)
+	if cache.Stats().Evictions == 0 {
+		me.Fatal("Eviction not counted")
+	}
+}
@@ -0,0 +1,108 @@
+package dnscache
+
+// Compact representation of the tree, for caches of millions of
+// names: the labels are interned (www or mail appear below many
+// domains), the nodes do not store their full name, which is rebuilt
+// from their parents, and the children of a node are in a slice
+// until there are too many of them for a linear search.
+
+import (
+	// Standard packages
+	"strings"
+	"unique"
+)
+
+// Above this number of children, a map is used
+const maxFewChildren = 8
+
+type children struct {
+	few  []*tree
+	many map[string]*tree // Keyed by the interned label
+}
+
+func intern(label string) unique.Handle[string] {
+	return unique.Make(label)
+}
+
+func (s *children) get(label string) (*tree, bool) {
+	if s.many != nil {
+		child, ok := s.many[label]
+		return child, ok
+	}
+	for _, child := range s.few {
+		if child.label.Value() == label {
+			return child, true
+		}
+	}
+	return nil, false
+}
+
+func (s *children) add(child *tree) {
+	if s.many == nil && len(s.few) < maxFewChildren {
+		s.few = append(s.few, child)
+		return
+	}
+	if s.many == nil {
+		s.many = make(map[string]*tree, 2*maxFewChildren)
+		for _, c := range s.few {
+			s.many[c.label.Value()] = c
+		}
+		s.few = nil
+	}
+	s.many[child.label.Value()] = child
+}
+
+func (s *children) remove(label string) {
+	if s.many != nil {
+		delete(s.many, label)
+		return
+	}
+	for i, child := range s.few {
+		if child.label.Value() == label {
+			last := len(s.few) - 1
+			copy(s.few[i:], s.few[i+1:])
+			s.few[last] = nil // Do not keep the node alive
+			s.few = s.few[:last]
+			return
+		}
+	}
+}
+
+func (s *children) len() int {
+	if s.many != nil {
+		return len(s.many)
+	}
+	return len(s.few)
+}
+
+func (s *children) each(fn func(child *tree)) {
+	if s.many != nil {
+		for _, child := range s.many {
+			fn(child)
+		}
+		return
+	}
+	for _, child := range s.few {
+		fn(child)
+	}
+}
+
+// The name of the node, without the trailing dot, "" for the root
+func (t *tree) name() string {
+	if t.parent == nil {
+		return ""
+	}
+	size := -1
+	for node := t; node.parent != nil; node = node.parent {
+		size += len(node.label.Value()) + 1
+	}
+	var name strings.Builder
+	name.Grow(size)
+	for node := t; node.parent != nil; node = node.parent {
+		if node != t {
+			name.WriteByte('.')
+		}
+		name.WriteString(node.label.Value())
+	}
+	return name.String()
+}
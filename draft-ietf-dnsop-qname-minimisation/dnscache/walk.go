@@ -0,0 +1,94 @@
+package dnscache
+
+// Enumeration of the cache, to export or audit what was learned.
+
+import (
+	// Standard packages
+	"bytes"
+	"sort"
+	"time"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+// What the cache knows about a name, as seen by Walk
+type Entry struct {
+	Exists      bool
+	Nameservers []string  // nil if we do not know, empty if the name is not a zone
+	TTL         uint32    // The one the entry was learned with
+	Expires     time.Time // Zero if the entry never expires
+	Expired     bool
+	Source      string // For a non-existing name, the server which said so, if known
+	Zone        string // The zone whose name servers told us, "" if unknown
+	Data        map[uint16]RRset
+}
+
+// The answer for a type
+type RRset struct {
+	Records []dns.RR // With their original TTL, nil for NODATA
+	NoData  bool
+	Expires time.Time
+	Zone    string // The zone whose name servers told us, "" if unknown
+}
+
+func (t *tree) entry(now time.Time) Entry {
+	entry := Entry{Exists: t.exists, TTL: t.ttl, Expires: t.expires, Expired: t.expired(now),
+		Source: t.source, Zone: t.zone}
+	if t.nameservers != nil {
+		entry.Nameservers = append([]string{}, *t.nameservers...)
+	}
+	if len(t.data) > 0 {
+		entry.Data = map[uint16]RRset{}
+		for qtype, set := range t.data {
+			result := RRset{NoData: set.nodata, Expires: set.expires, Zone: set.zone}
+			for _, rr := range set.records {
+				result.Records = append(result.Records, dns.Copy(rr))
+			}
+			entry.Data[qtype] = result
+		}
+	}
+	return entry
+}
+
+// Visits the node then its children, in canonical order. Returns false
+// if the walk must stop.
+func (t *tree) walk(now time.Time, fn func(name string, entry Entry) bool) bool {
+	if !fn(t.name(), t.entry(now)) {
+		return false
+	}
+	type child struct {
+		wire []byte
+		node *tree
+	}
+	children := make([]child, 0, t.children.len())
+	t.children.each(func(node *tree) {
+		wire := canonicalLabels(node.label.Value())
+		if len(wire) != 1 { // Should not happen, labels come from Cache.labels
+			wire = [][]byte{[]byte(node.label.Value())}
+		}
+		children = append(children, child{wire: wire[0], node: node})
+	})
+	sort.Slice(children, func(i, j int) bool {
+		return bytes.Compare(children[i].wire, children[j].wire) < 0
+	})
+	for _, c := range children {
+		if !c.node.walk(now, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// Walk calls fn for every name of the cache, the root ("") first, in
+// the canonical order of RFC 4034, section 6.1, until fn returns
+// false. Expired entries are visited too. The cache is locked during
+// the walk so fn must not modify it.
+func (c *Cache) Walk(fn func(name string, entry Entry) bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	c.root.walk(c.clock(), fn)
+}
+
+func Walk(fn func(name string, entry Entry) bool) {
+	Default.Walk(fn)
+}
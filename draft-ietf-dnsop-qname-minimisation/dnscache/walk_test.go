@@ -0,0 +1,80 @@
+package dnscache
+
+import (
+	// Standard packages
+	"strings"
+	"testing"
+	// External packages
+	"github.com/miekg/dns"
+)
+
+func TestWalkOrder(me *testing.T) {
+	cache := New(Options{})
+	// The example of RFC 4034, section 6.1
+	for _, name := range []string{"z.example", `\001.z.example`, "*.z.example", `\200.z.example`,
+		"yljkjljk.a.example", "Z.a.example", "zABC.a.EXAMPLE", "a.example", "example"} {
+		cache.PutNx(name, 300)
+	}
+	names := []string{}
+	cache.Walk(func(name string, entry Entry) bool {
+		names = append(names, name)
+		return true
+	})
+	expected := []string{"", "example", "a.example", "yljkjljk.a.example", "z.a.example", "zabc.a.example",
+		"z.example", `\001.z.example`, `*.z.example`, `\200.z.example`}
+	if strings.Join(names, " ") != strings.Join(expected, " ") {
+		me.Fatalf("Wrong order: %v", names)
+	}
+}
+
+func TestWalkEntries(me *testing.T) {
+	cache, clock := newFakeCache()
+	cache.PutIn("example", "zone.example", []string{"ns1.zone.example", "ns2.zone.example"}, 600)
+	cache.PutRRsetIn("zone.example", "www.zone.example", dns.TypeAAAA, []dns.RR{mustRR("www.zone.example. 300 IN AAAA 2001:db8::1")})
+	cache.PutNoData("www.zone.example", dns.TypeMX, 100)
+	cache.PutNxFrom("nx.zone.example", "ns1.zone.example", 60)
+	clock.advance(120)
+	entries := map[string]Entry{}
+	cache.Walk(func(name string, entry Entry) bool {
+		entries[name] = entry
+		return true
+	})
+	if len(entries) != 5 {
+		me.Fatalf("%d entries instead of 5", len(entries))
+	}
+	zone := entries["zone.example"]
+	if !zone.Exists || len(zone.Nameservers) != 2 || zone.TTL != 600 || zone.Zone != "example" || zone.Expired {
+		me.Fatalf("Wrong zone entry %+v", zone)
+	}
+	if entries["example"].Nameservers != nil || !entries["example"].Expires.IsZero() {
+		me.Fatal("Wrong intermediate entry")
+	}
+	www := entries["www.zone.example"]
+	if len(www.Data) != 2 || len(www.Data[dns.TypeAAAA].Records) != 1 || www.Data[dns.TypeAAAA].Records[0].Header().Ttl != 300 ||
+		www.Data[dns.TypeAAAA].Zone != "zone.example" || !www.Data[dns.TypeMX].NoData {
+		me.Fatalf("Wrong data %+v", www)
+	}
+	// The entry is a copy
+	www.Data[dns.TypeAAAA].Records[0].Header().Ttl = 1
+	if _, _, records := cache.Get("www.zone.example", dns.TypeAAAA); records[0].Header().Ttl != 180 {
+		me.Fatal("Cache modified through an entry")
+	}
+	nx := entries["nx.zone.example"]
+	if nx.Exists || nx.Source != "ns1.zone.example" || !nx.Expired {
+		me.Fatalf("Wrong non-existing entry %+v", nx)
+	}
+}
+
+func TestWalkStop(me *testing.T) {
+	cache := New(Options{})
+	cache.PutNx("a.example", 300)
+	cache.PutNx("b.example", 300)
+	visited := 0
+	cache.Walk(func(name string, entry Entry) bool {
+		visited++
+		return name != "a.example"
+	})
+	if visited != 3 {
+		me.Fatalf("%d names visited instead of 3", visited)
+	}
+}
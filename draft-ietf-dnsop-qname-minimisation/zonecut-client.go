@@ -3,7 +3,7 @@ package main
 import (
 	"flag"
 	"net"
-	"io"
+	"io/ioutil"
 	"fmt"
 )
 
@@ -14,7 +14,7 @@ const (
 func main() {
 	flag.Parse()
 	if flag.NArg() != 2 && flag.NArg() != 1 {
-		panic("Usage: program domain [qtype as a number] ...")
+		panic("Usage: program domain [qtype as a number, or \"stats\", \"delete\", \"flush\"] ...")
 	}
 	c, err := net.Dial("unix", "@"+SOCKET_NAME)
 	if err != nil {
@@ -30,13 +30,9 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	buf := make([]byte, 512)
-	nr, err := c.Read(buf)
+	data, err := ioutil.ReadAll(c) // The server closes the connection after the reply
 	if err != nil {
-		if err != io.EOF {
-			panic(err)
-		}
+		panic(err)
 	}
-	data := buf[0:nr]
 	fmt.Printf("Got \"%s\"\n", string(data))
 }
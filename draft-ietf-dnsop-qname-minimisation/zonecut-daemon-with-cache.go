@@ -4,25 +4,54 @@
 If you are not used to the Go programming language, fast compile
 instructions:
 
-1) Install Go
+1) Install Go, version 1.23 or later (dnscache uses the package unique)
 
-2) export GOPATH=$(pwd)
+2) cd dnscache && go mod init dnscache && cd ..
 
-3) go get github.com/miekg/dns
+3) go mod init zonecut && go mod edit -replace dnscache=./dnscache
 
-4) go build zonecut.go
+4) go mod tidy (it downloads github.com/miekg/dns, and
+golang.org/x/net, used by dnscache for -i)
 
-5) ./zonecut
+5) go build zonecut-daemon-with-cache.go && go build zonecut-client.go
 
-6) TODO the client
+6) ./zonecut-daemon-with-cache then, from another terminal,
+./zonecut-client www.example.com 28 (the query type is a number)
 
-Limitations: only uses one name server per zone. So, it is very
-brittle: if this name server happens to be broken, resolution will
-fail.
+All the name servers of a zone are kept. When one times out, or
+replies SERVFAIL or REFUSED, the next one is tried, and resolution
+fails only when none of them answered.
 
-We cheat a bit by relying on the local resolver to find IP addresses
-of name servers from their zones. So, we do not process glue
-records.
+The addresses of name servers come from the glue records and from
+our own answers, which are kept in the cache. When we do not know them,
+we resolve them, with the same algorithm, never with the local
+resolver. There are limits against circular dependencies between
+zones, too deep chains of such resolutions (MAXDEPTH) and too many of
+them for one query (MAXSUBRESOLUTIONS).
+
+The name servers are asked over IPv4 first, then IPv6 if IPv4 fails
+(for instance because it is unreachable), or the opposite with
+-prefer6. -4 and -6 use only one family, without fallback.
+
+With -w, when resolution fails, answers which expired recently are
+served, marked as stale (RFC 8767).
+
+With -p, the popular entries are resolved again, in the background,
+before they expire, so that clients do not wait for them.
+
+At startup, and when their TTL runs out, the list of the root name
+servers is asked to the root name servers themselves (priming, RFC
+8109), the hints (builtin, or -hints) are only used for that.
+
+Sending "stats" instead of the query type (zonecut-client . stats)
+returns the statistics of the cache. "delete" forgets what the cache
+knows about the name, "flush" forgets the name and everything below
+it (zonecut-client broken.example flush).
+
+CNAME and DNAME (RFC 6672) records are cached and followed, the
+resolution restarting, from the zone cut of the target, at most
+MAXALIASES times. A DNAME may redirect a whole TLD, for instance from
+the root, to empty.as112.arpa (RFC 7535).
 
 Stephane Bortzmeyer <bortzmeyer@nic.fr>
 */
@@ -36,8 +65,10 @@ import (
 	"io"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 	// External libraries
 	"github.com/miekg/dns"
@@ -50,25 +81,66 @@ const (
 	MAXTRIALS   uint    = 3
 	QTYPE       uint16  = dns.TypeA
 	SOCKET_NAME string  = "/tmp/zonecut.sock"
+	// When priming fails, how long before we try again
+	PRIMING_RETRY time.Duration = 60 * time.Second
+	// How often we look for entries to prefetch
+	PREFETCH_INTERVAL time.Duration = 10 * time.Second
+	// Maximum number of CNAME and DNAME followed, against loops
+	MAXALIASES int = 8
+	// Resolving the address of a name server may require resolving
+	// the address of another name server, and so on, at most that
+	// deep
+	MAXDEPTH int = 4
+	// Maximum number of name server addresses resolved for one query
+	MAXSUBRESOLUTIONS int = 16
+)
+
+// Address family policy, for the transport to the name servers
+const (
+	FAMILY_PREFER_V4 = iota // Default
+	FAMILY_PREFER_V6
+	FAMILY_ONLY_V4
+	FAMILY_ONLY_V6
 )
 
 type Reply struct {
 	retrieved     bool
 	rcode         int
 	authoritative bool
+	referral      bool // No answer, dnsdata is the authority section
 	dnsdata       []dns.RR
+	authority     []dns.RR // For the SOA, needed by negative caching
+	additional    []dns.RR // For the glue
 	msg           string
+	server        string // The one which replied
 }
 
 var ( // Global vars
-	timeout   time.Duration
-	maxTrials *int
-	qtypeI    int
-	qtype     uint16
-	verbose   *bool
+	timeout    time.Duration
+	maxTrials  *int
+	qtypeI     int
+	qtype      uint16
+	verbose    *bool
+	nxCut      dnscache.NXDomainCut
+	aggressive *bool
+	family     int
 )
 
-func nsQuery(qname string, server string, qtype uint16, acceptReferrals bool) Reply {
+// State of the resolution of a client query, shared with the
+// resolutions of the addresses of the name servers it needs
+type task struct {
+	depth   int             // 0 for the client query
+	pending map[string]bool // Name servers whose address is being resolved
+	left    *int            // Resolutions of addresses still allowed
+	stale   bool            // After a failure, expired zone cuts and addresses can be used (RFC 8767)
+}
+
+func newTask() *task {
+	left := MAXSUBRESOLUTIONS
+	return &task{depth: 0, pending: map[string]bool{}, left: &left}
+}
+
+func nsQuery(qname string, server string, address string, qtype uint16, acceptReferrals bool) Reply {
 	var (
 		trials uint
 		result Reply
@@ -82,13 +154,27 @@ func nsQuery(qname string, server string, qtype uint16, acceptReferrals bool) Re
 	c := new(dns.Client)
 	c.ReadTimeout = timeout
 	m.Question[0] = dns.Question{qname, qtype, dns.ClassINET}
+	if *aggressive {
+		m.SetEdns0(4096, true) // We need the NSEC or NSEC3 records
+	} else if qname == "." && qtype == dns.TypeNS {
+		// Priming: 512 bytes are not enough for the addresses of
+		// all the root name servers (RFC 8109, section 3)
+		m.SetEdns0(4096, false)
+	}
 	nsAddressPort := ""
-	nsAddressPort = net.JoinHostPort(server, "53")
+	nsAddressPort = net.JoinHostPort(address, "53")
 	if *verbose {
-		fmt.Fprintf(os.Stdout, "Querying type %d for name %s at server %s\n", qtype, qname, server)
+		fmt.Fprintf(os.Stdout, "Querying type %d for name %s at server %s (%s)\n", qtype, qname, server, nsAddressPort)
 	}
 	for trials = 0; trials < uint(*maxTrials); trials++ {
 		answer, _, err := c.Exchange(m, nsAddressPort)
+		if answer != nil && answer.Truncated {
+			if *verbose {
+				fmt.Fprintf(os.Stdout, "Truncated reply from %s, retrying over TCP\n", server)
+			}
+			tcp := &dns.Client{Net: "tcp", ReadTimeout: timeout}
+			answer, _, err = tcp.Exchange(m, nsAddressPort)
+		}
 		if answer == nil {
 			if *verbose {
 				fmt.Fprintf(os.Stderr, "Error when querying %s: \"%s\"\n", server, err)
@@ -98,6 +184,8 @@ func nsQuery(qname string, server string, qtype uint16, acceptReferrals bool) Re
 		} else {
 			result.rcode = answer.Rcode
 			result.authoritative = answer.Authoritative
+			result.authority = answer.Ns
+			result.additional = answer.Extra
 			if answer.Rcode != dns.RcodeSuccess {
 				result.msg = dns.RcodeToString[answer.Rcode]
 				break
@@ -111,6 +199,7 @@ func nsQuery(qname string, server string, qtype uint16, acceptReferrals bool) Re
 							result.dnsdata = answer.Answer
 						} else {
 							result.msg = "Referral(s)"
+							result.referral = true
 							result.dnsdata = answer.Ns
 						}
 					} else {
@@ -129,8 +218,701 @@ func nsQuery(qname string, server string, qtype uint16, acceptReferrals bool) Re
 	return result
 }
 
+// True if another name server of the zone may do better
+func tryNext(result Reply) bool {
+	return !result.retrieved && (result.rcode == dns.RcodeSuccess || // Timeout or network error
+		result.rcode == dns.RcodeServerFailure || result.rcode == dns.RcodeRefused)
+}
+
+// Asks the name servers of the zone, one after the other, until one
+// replies. Each attempt is reported.
+func query(zone string, servers []string, qname string, qtype uint16, acceptReferrals bool, t *task) Reply {
+	var result Reply
+	for i, server := range servers {
+		candidates, err := serverAddresses(server, t)
+		if err != nil {
+			result = Reply{retrieved: false, msg: err.Error()}
+			fmt.Fprintf(os.Stderr, "Server %s (%d/%d) of \"%s\" skipped: %s\n", server, i+1, len(servers), zone, err)
+			continue
+		}
+		for _, address := range candidates {
+			result = nsQuery(qname, server, address, qtype, acceptReferrals)
+			if result.retrieved || result.rcode != dns.RcodeSuccess { // It replied, the other addresses would say the same
+				break
+			}
+			// May be this family is unreachable, try the other addresses
+			fmt.Fprintf(os.Stderr, "Address %s of %s failed: %s\n", address, server, result.msg)
+		}
+		result.server = server
+		if !tryNext(result) {
+			if *verbose {
+				fmt.Fprintf(os.Stdout, "Server %s (%d/%d) of \"%s\" replied: %s\n", server, i+1, len(servers), zone, result.msg)
+			}
+			return result
+		}
+		fmt.Fprintf(os.Stderr, "Server %s (%d/%d) of \"%s\" failed: %s\n", server, i+1, len(servers), zone, result.msg)
+	}
+	result.msg = fmt.Sprintf("all the %d name servers of \"%s\" failed, the last one with %s", len(servers), zone, result.msg)
+	return result
+}
+
+// The addresses to try, in order, according to the address family
+// policy. With a preference, the other family is kept as a fallback.
+func byFamily(ips []net.IP) []string {
+	v4 := []string{}
+	v6 := []string{}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip.String())
+		} else {
+			v6 = append(v6, ip.String())
+		}
+	}
+	switch family {
+	case FAMILY_ONLY_V4:
+		return v4
+	case FAMILY_ONLY_V6:
+		return v6
+	case FAMILY_PREFER_V6:
+		return append(v6, v4...)
+	}
+	return append(v4, v6...)
+}
+
+// The addresses of a name server, in the order of the address family
+// policy, from the cache (glue, hints or previous answers). If we do
+// not know them, we resolve them ourselves, like any other name,
+// without the system resolver, which would see all the names.
+func serverAddresses(server string, t *task) ([]string, error) {
+	if candidates := byFamily(dnscache.Default.Addresses(server)); len(candidates) > 0 {
+		return candidates, nil
+	}
+	if t.stale { // The glue usually expires with the delegation
+		if candidates := byFamily(dnscache.Default.StaleAddresses(server)); len(candidates) > 0 {
+			return candidates, nil
+		}
+	}
+	name := dns.Fqdn(strings.ToLower(server))
+	if t.pending[name] { // For instance, ns.example.com served by ns.example.net, and vice-versa
+		return nil, fmt.Errorf("circular dependency, the address of %s is needed to find it", name)
+	}
+	if t.depth >= MAXDEPTH {
+		return nil, fmt.Errorf("address of %s not resolved, already %d name servers deep", name, t.depth)
+	}
+	if *t.left <= 0 {
+		return nil, fmt.Errorf("address of %s not resolved, %d name servers resolved already for this query", name, MAXSUBRESOLUTIONS)
+	}
+	*t.left--
+	t.pending[name] = true
+	defer delete(t.pending, name)
+	sub := &task{depth: t.depth + 1, pending: t.pending, left: t.left, stale: t.stale}
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA} // Both, for the fallback
+	switch family {
+	case FAMILY_ONLY_V4:
+		qtypes = []uint16{dns.TypeA}
+	case FAMILY_ONLY_V6:
+		qtypes = []uint16{dns.TypeAAAA}
+	case FAMILY_PREFER_V6:
+		qtypes = []uint16{dns.TypeAAAA, dns.TypeA}
+	}
+	found := []net.IP{}
+	for _, qtype := range qtypes {
+		if *verbose {
+			fmt.Fprintf(os.Stdout, "\nResolving type %d for name server %s (depth %d)\n", qtype, name, sub.depth)
+		}
+		result := resolve(name, qtype, false, 0, sub)
+		if *verbose {
+			fmt.Fprintf(os.Stdout, "Name server %s: %s\n\n", name, result)
+		}
+		_, _, records := dnscache.Peek(name, qtype)
+		// Kept with the glue, since it is a name server
+		dnscache.Default.PutAddresses(name, records)
+		for _, rr := range records {
+			switch record := rr.(type) {
+			case *dns.A:
+				found = append(found, record.A)
+			case *dns.AAAA:
+				found = append(found, record.AAAA)
+			}
+		}
+	}
+	if candidates := byFamily(found); len(candidates) > 0 {
+		return candidates, nil
+	}
+	return nil, fmt.Errorf("no address found for %s", name)
+}
+
+// RFC 8198: keep the NSEC and NSEC3 records of a negative answer. We
+// do not validate them so it is only for experiments with servers you
+// trust. The records must come from a server of parent.
+func cacheDenial(parent string, authority []dns.RR) {
+	if !*aggressive {
+		return
+	}
+	zone := ""
+	for i := range authority {
+		soa, ok := authority[i].(*dns.SOA)
+		if ok {
+			zone = soa.Hdr.Name
+		}
+	}
+	if zone == "" || !dns.IsSubDomain(parent, zone) {
+		return
+	}
+	for i := range authority {
+		switch rr := authority[i].(type) {
+		case *dns.NSEC:
+			dnscache.Default.PutNSEC(zone, rr)
+		case *dns.NSEC3:
+			dnscache.Default.PutNSEC3(zone, rr)
+		}
+	}
+}
+
+// The cache refused data, probably out of bailiwick
+func rejected(name string, err error) {
+	if err != nil && *verbose {
+		fmt.Fprintf(os.Stdout, "Data for \"%s\" not cached: %s\n", name, err)
+	}
+}
+
+// Keeps the NS records of the child from a referral by a server of
+// parent, and their glue
+func cacheReferral(parent string, child string, result Reply) []string {
+	referral := []string{}
+	ttl := uint32(0)
+	for i := range result.dnsdata {
+		ans := result.dnsdata[i]
+		switch ans.(type) {
+		case *dns.NS:
+			record := ans.(*dns.NS)
+			if record.Header().Name == child { // Some middleboxes add NS records of the parent...
+				if len(referral) == 0 || record.Header().Ttl < ttl {
+					ttl = record.Header().Ttl
+				}
+				referral = append(referral, record.Ns)
+			}
+		}
+	}
+	if len(referral) > 0 {
+		rejected(child, dnscache.PutIn(parent, child, referral, ttl))
+		for _, ns := range referral {
+			rejected(ns, dnscache.Default.PutAddressesIn(parent, ns, result.additional))
+		}
+	}
+	return referral
+}
+
+// The aliases (CNAME and DNAME) in an answer for domain are cached,
+// and followed. Returns the name they lead to, the aliases and the
+// records of type qtype at this name.
+func cacheAliases(parent string, domain string, qtype uint16, answer []dns.RR) (target string, chain []dns.RR, final []dns.RR) {
+	target = domain
+	for aliases := 0; aliases <= MAXALIASES; aliases++ {
+		dname := findDNAME(target, answer)
+		if dname != nil {
+			rejected(dname.Header().Name, dnscache.PutRRsetIn(parent, dname.Header().Name, dns.TypeDNAME, []dns.RR{dname}))
+			chain = append(chain, dname)
+		}
+		var cname *dns.CNAME
+		for _, rr := range answer {
+			if record, ok := rr.(*dns.CNAME); ok && qtype != dns.TypeCNAME && strings.EqualFold(record.Header().Name, target) {
+				cname = record
+				break
+			}
+		}
+		if cname != nil {
+			rejected(target, dnscache.PutRRsetIn(parent, target, dns.TypeCNAME, []dns.RR{cname}))
+			chain = append(chain, cname)
+			target = cname.Target
+		} else if dname != nil { // The server did not synthesize the CNAME
+			target = substitute(target, dname)
+		} else {
+			break
+		}
+	}
+	for _, rr := range answer {
+		if strings.EqualFold(rr.Header().Name, target) && (qtype == dns.TypeANY || rr.Header().Rrtype == qtype) {
+			final = append(final, rr)
+		}
+	}
+	return target, chain, final
+}
+
+// The DNAME record of an ancestor of child in the answer, nil if there
+// is none.
+func findDNAME(child string, answer []dns.RR) *dns.DNAME {
+	for _, rr := range answer {
+		if record, ok := rr.(*dns.DNAME); ok {
+			owner := record.Header().Name
+			if dns.IsSubDomain(owner, child) && !strings.EqualFold(owner, child) {
+				return record
+			}
+		}
+	}
+	return nil
+}
+
+// Replaces the owner of the DNAME record, at the end of domain, by its
+// target (RFC 6672, section 2.2).
+func substitute(domain string, dname *dns.DNAME) string {
+	prefix := dns.SplitDomainName(domain)
+	prefix = prefix[:len(prefix)-dns.CountLabel(dname.Header().Name)]
+	target := dns.Fqdn(dname.Target)
+	if target == "." {
+		return dns.Fqdn(strings.Join(prefix, "."))
+	}
+	return strings.Join(prefix, ".") + "." + target
+}
+
+// Resolution of the target of an alias, from the start since it may
+// be in another zone.
+func follow(chain []dns.RR, target string, qtype uint16, aliases int, t *task) string {
+	if aliases >= MAXALIASES {
+		fmt.Fprintf(os.Stderr, "Too many aliases, the last one to \"%s\"\n", target)
+		return "Too many aliases"
+	}
+	if *verbose {
+		fmt.Fprintf(os.Stdout, "\nAlias to \"%s\", restarting the resolution\n", target)
+	}
+	return fmt.Sprintf("Alias %s then %s", chain, resolve(dns.Fqdn(target), qtype, false, aliases+1, t))
+}
+
+// Resolves again the popular entries before they expire
+func prefetch(minHits uint64, threshold time.Duration) {
+	for range time.Tick(PREFETCH_INTERVAL) {
+		for _, entry := range dnscache.Default.Popular(minHits, threshold) {
+			if *verbose {
+				fmt.Fprintf(os.Stdout, "Prefetching %d for %s (%d hits, %d seconds left)\n",
+					entry.Qtype, entry.Name, entry.Hits, entry.TTL)
+			}
+			result := resolve(dns.Fqdn(entry.Name), entry.Qtype, true, 0, newTask())
+			if *verbose {
+				fmt.Fprintf(os.Stdout, "Prefetch result for %s: %s\n", entry.Name, result)
+			}
+		}
+	}
+}
+
+// The statistics of the cache, in text, for the "stats" request
+func statistics() string {
+	stats := dnscache.Default.Stats()
+	result := fmt.Sprintf("Hits: %d\nMisses: %d\nNegative hits: %d\nNXDOMAIN cut hits: %d\nEvictions: %d\nRejections: %d\n",
+		stats.Hits, stats.Misses, stats.NegativeHits, stats.NXDomainCutHits, stats.Evictions, stats.Rejections)
+	result += fmt.Sprintf("Entries: %d\nBytes: %d\n", stats.Entries, stats.Bytes)
+	for depth := range stats.Nodes {
+		result += fmt.Sprintf("Depth %d: %d nodes, %d leaves\n", depth, stats.Nodes[depth], stats.Leaves[depth])
+	}
+	return result
+}
+
+// Root priming (RFC 8109): the root name servers give their own list,
+// which replaces the hints in the cache. Returns the TTL of this list.
+func prime(hints *dnscache.Hints) (ttl uint32, ok bool) {
+	for _, server := range hints.Servers {
+		candidates, err := serverAddresses(server, newTask())
+		if err != nil {
+			if *verbose {
+				fmt.Fprintf(os.Stdout, "Priming with %s impossible: %s\n", server, err)
+			}
+			continue
+		}
+		result := nsQuery(".", server, candidates[0], dns.TypeNS, false)
+		for _, address := range candidates[1:] {
+			if result.retrieved || result.rcode != dns.RcodeSuccess {
+				break
+			}
+			result = nsQuery(".", server, address, dns.TypeNS, false)
+		}
+		if !result.retrieved || !result.authoritative {
+			if *verbose {
+				fmt.Fprintf(os.Stdout, "Priming with %s failed: %s\n", server, result.msg)
+			}
+			continue
+		}
+		root := []string{}
+		for i := range result.dnsdata {
+			if ns, isNS := result.dnsdata[i].(*dns.NS); isNS && ns.Hdr.Name == "." {
+				if len(root) == 0 || ns.Hdr.Ttl < ttl {
+					ttl = ns.Hdr.Ttl
+				}
+				root = append(root, ns.Ns)
+			}
+		}
+		if len(root) == 0 {
+			continue
+		}
+		compareHints(hints, root, result.additional)
+		dnscache.Default.PutRoot(root, ttl)
+		for _, ns := range root {
+			dnscache.Default.PutAddresses(ns, result.additional)
+		}
+		if *verbose {
+			fmt.Fprintf(os.Stdout, "Primed with %s: %d root name servers, for %d seconds\n", server, len(root), ttl)
+		}
+		return ttl, true
+	}
+	return 0, false
+}
+
+// Warns if the priming answer is not what the hints said
+func compareHints(hints *dnscache.Hints, root []string, additional []dns.RR) {
+	known := map[string]bool{}
+	for _, ns := range hints.Servers {
+		known[ns] = true
+	}
+	primed := map[string]bool{}
+	for _, ns := range root {
+		ns = strings.ToLower(strings.TrimSuffix(ns, "."))
+		primed[ns] = true
+		if !known[ns] {
+			fmt.Fprintf(os.Stderr, "Warning: root name server %s is not in the hints\n", ns)
+		}
+	}
+	for _, ns := range hints.Servers {
+		if !primed[ns] {
+			fmt.Fprintf(os.Stderr, "Warning: root name server %s of the hints is not in the priming answer\n", ns)
+		}
+	}
+	for i := range additional {
+		var address net.IP
+		switch rr := additional[i].(type) {
+		case *dns.A:
+			address = rr.A
+		case *dns.AAAA:
+			address = rr.AAAA
+		default:
+			continue
+		}
+		ns := strings.ToLower(strings.TrimSuffix(additional[i].Header().Name, "."))
+		if !known[ns] {
+			continue // Already reported
+		}
+		found := false
+		for _, hint := range hints.Addresses[ns] {
+			found = found || hint.Equal(address)
+		}
+		if !found {
+			fmt.Fprintf(os.Stderr, "Warning: address %s of root name server %s is not in the hints\n", address, ns)
+		}
+	}
+}
+
+// Primes again when the TTL of the root NS set runs out
+func primeLoop(hints *dnscache.Hints, ttl uint32, ok bool) {
+	for {
+		if ok && time.Duration(ttl)*time.Second > PRIMING_RETRY {
+			time.Sleep(time.Duration(ttl) * time.Second)
+		} else if ok {
+			time.Sleep(PRIMING_RETRY)
+		} else {
+			fmt.Fprintf(os.Stderr, "Root priming failed, using the hints\n")
+			time.Sleep(PRIMING_RETRY)
+		}
+		ttl, ok = prime(hints)
+	}
+}
+
+// Removes a name ("delete") or a whole subtree ("flush") from the cache
+func purge(name string, how string) string {
+	if *verbose {
+		fmt.Fprintf(os.Stdout, "Request to %s %s\n", how, name)
+	}
+	if how == "delete" {
+		if dnscache.Default.Delete(name) {
+			return fmt.Sprintf("%s deleted", name)
+		}
+		return fmt.Sprintf("%s not in cache", name)
+	}
+	return fmt.Sprintf("%d entries flushed", dnscache.Default.FlushBelow(name))
+}
+
+func loadSnapshot(filename string) {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) { // Probably the first run
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Cannot read the snapshot: %s\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	err = dnscache.Default.Load(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot load the snapshot %s: %s\n", filename, err)
+		os.Exit(1)
+	}
+	if *verbose {
+		entries, _ := dnscache.Default.Size()
+		fmt.Fprintf(os.Stdout, "%d entries loaded from %s\n", entries, filename)
+	}
+}
+
+// Write to a temporary file first, so a crash does not leave a truncated snapshot
+func saveSnapshot(filename string) {
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot save the snapshot: %s\n", err)
+		return
+	}
+	err = dnscache.Default.Save(f)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(filename+".tmp", filename)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot save the snapshot: %s\n", err)
+		return
+	}
+	if *verbose {
+		fmt.Fprintf(os.Stdout, "Cache saved to %s\n", filename)
+	}
+}
+
+// Resolves the name with QNAME minimisation and returns a description
+// of the result. With refresh, the cache is not used for the answer, only for
+// the zone cuts above it.
+// aliases is the number of CNAME and DNAME already followed to reach
+// domain, t is shared with the resolutions of name server addresses.
+func resolve(domain string, qtype uint16, refresh bool, aliases int, t *task) string {
+	remainingLabels := dns.SplitDomainName(domain)
+
+	// Step numbers in the program are from
+	// draft-ietf-dnsop-qname-minimisation-02. Other versions may
+	// be different.
+
+	// Start resolving the domain name. Start with the cache (step 0).
+	finalResult := "UNINITIALIZED"
+	failed := false
+	nameservers := make(map[string][]string)
+	var (
+		ok    dnscache.Reply
+		rdata []dns.RR
+	)
+	if refresh && domain != "." { // Start above the name, so its delegation is refreshed, too
+		labels := dns.SplitDomainName(domain)
+		ok, _, _ = dnscache.Peek(strings.Join(labels[1:], "."), dns.TypeNS)
+		ok.Exists = nil
+	}
+	if !refresh || domain == "." || ok.Target != "" { // Aliases are followed by the cache
+		lookup := dnscache.Peek
+		if !refresh && aliases == 0 && t.depth == 0 { // The query of a client, for the statistics
+			lookup = dnscache.Get
+		}
+		ok, _, rdata = lookup(domain, qtype)
+	}
+	if ok.Target != "" && (ok.Exists == nil || (*ok.Exists && ok.NoData == nil)) {
+		// We know the alias, not the data of its target
+		chain := []dns.RR{}
+		for _, rr := range rdata {
+			if rr.Header().Rrtype == dns.TypeCNAME || rr.Header().Rrtype == dns.TypeDNAME {
+				chain = append(chain, rr)
+			}
+		}
+		return follow(chain, ok.Target, qtype, aliases+len(chain)-1, t)
+	}
+	if ok.Exists == nil || (*ok.Exists && ok.NoData == nil) { // Not in the cache
+
+		// Find closest enclosing NS RRset in your cache. Step 1.
+		parent := dns.Fqdn(ok.Closest)
+		_, pnameservers, _ := dnscache.Peek(ok.Closest, dns.TypeNS)
+		staleTried := false
+	StaleLoop:
+		nameservers[parent] = pnameservers
+		remainingLabels = dns.SplitDomainName(domain)
+		remainingLabels = remainingLabels[0 : len(remainingLabels)-dns.CountLabel(parent)]
+
+		leaf := false
+	NodeLoop:
+		for !leaf {
+			if *verbose {
+				fmt.Fprintf(os.Stdout, "\nZone cut at \"%s\"\n", parent)
+			}
+
+			// Step 2
+			child := parent
+
+			zonecut := false
+			// InTheZoneLoop:
+			for !zonecut {
+				// Step 3
+				if child == domain {
+					// For NS, the server of the parent replies with a referral
+					result := query(parent, nameservers[parent], domain, qtype, qtype == dns.TypeNS, t)
+					if result.rcode == dns.RcodeNameError {
+						finalResult = "No such domain"
+						rejected(domain, dnscache.PutNxIn(parent, domain, result.server, dnscache.NegativeTTL(result.authority)))
+						cacheDenial(parent, result.authority)
+						break NodeLoop
+					}
+					if !result.retrieved {
+						fmt.Fprintf(os.Stderr, "Error in retrieving the final result: \"%s\"\n", result.msg)
+						finalResult = fmt.Sprintf("Error %s", result.msg)
+						failed = true
+						break NodeLoop
+					}
+					referral := []string{}
+					if result.referral {
+						referral = cacheReferral(parent, domain, result)
+					}
+					if len(referral) > 0 {
+						finalResult = fmt.Sprintf("Delegation to %s", referral)
+					} else if len(result.dnsdata) == 0 || result.referral {
+						finalResult = "No data of this type"
+						rejected(domain, dnscache.PutNoDataIn(parent, domain, qtype, dnscache.NegativeTTL(result.authority)))
+						cacheDenial(parent, result.authority)
+					} else {
+						target, chain, final := cacheAliases(parent, domain, qtype, result.dnsdata)
+						err := dnscache.ErrOutOfBailiwick // No data at the end of the aliases
+						if len(final) > 0 {
+							err = dnscache.PutRRsetIn(parent, target, qtype, final)
+							rejected(target, err)
+						}
+						if len(chain) > 0 && err == dnscache.ErrOutOfBailiwick {
+							// The target is in another zone, its servers must be asked
+							finalResult = follow(chain, target, qtype, aliases+len(chain)-1, t)
+						} else if len(final) == 0 {
+							finalResult = "No data of this type"
+						} else {
+							finalResult = fmt.Sprintf("%s", result.dnsdata)
+						}
+					}
+					leaf = true
+					zonecut = true
+					break NodeLoop
+				} else {
+					// Step 4
+					if child == "." {
+						child = dns.Fqdn(remainingLabels[len(remainingLabels)-1])
+					} else {
+						child = remainingLabels[len(remainingLabels)-1] + "." + child
+					}
+					remainingLabels = remainingLabels[0 : len(remainingLabels)-1]
+					// Step 5
+					cached, _, _ := dnscache.Peek(child, dns.TypeNS)
+					if cached.Exists != nil && !*cached.Exists {
+						finalResult = "No such domain (in cache)"
+						break NodeLoop
+					}
+					if cached.NoData != nil && *cached.NoData {
+						if *verbose {
+							fmt.Fprintf(os.Stdout, "Negative cache entry for NS at \"%s\"\n", child)
+						}
+						continue // Back to step 3
+					}
+					// Step 6
+					result := query(parent, nameservers[parent], child, dns.TypeNS, true, t)
+					if !result.retrieved {
+						fmt.Fprintf(os.Stderr, "Error in retrieving the intermediate result: \"%s\"\n", result.msg)
+						if tryNext(result) { // No server left to ask
+							finalResult = fmt.Sprintf("Error %s", result.msg)
+							failed = true
+							break NodeLoop
+						}
+					}
+					if *verbose {
+						fmt.Fprintf(os.Stdout, "Result for \"%s\": %s\n", child, result.msg)
+					}
+					// 6c
+					if result.rcode == dns.RcodeNameError { // NXDOMAIN
+						if nxCut == dnscache.NXDomainCutHardened && !dnscache.Default.BrokenENT(result.server) {
+							// Some servers return NXDOMAIN for ENTs, check with the full name
+							// Same server, with the address fallback of query
+							check := query(parent, []string{result.server}, domain, qtype, true, t)
+							if check.retrieved && check.rcode == dns.RcodeSuccess { // Not a timeout
+								fmt.Fprintf(os.Stderr, "Server %s returns NXDOMAIN for the empty non-terminal \"%s\"\n",
+									result.server, child)
+								dnscache.Default.MarkBrokenENT(result.server)
+							}
+						}
+						if nxCut == dnscache.NXDomainCutHardened && dnscache.Default.BrokenENT(result.server) {
+							continue // Back to step 3, as for 6d
+						}
+						fmt.Fprintf(os.Stderr, "Name \"%s\" does not exist\n", child)
+						finalResult = "No such domain"
+						rejected(child, dnscache.PutNxIn(parent, child, result.server, dnscache.NegativeTTL(result.authority)))
+						cacheDenial(parent, result.authority)
+						break NodeLoop
+					}
+					if result.rcode != dns.RcodeSuccess { //
+						fmt.Fprintf(os.Stderr, "Fatal error %s\n", result.msg)
+						finalResult = fmt.Sprintf("Fatal error %s", result.msg)
+						failed = true
+						break NodeLoop
+					}
+					if dname := findDNAME(child, result.dnsdata); dname != nil && dns.IsSubDomain(parent, dname.Header().Name) {
+						// The zone of the parent redirects the names below
+						// one of its nodes, for instance a whole TLD (RFC 6672)
+						rejected(dname.Header().Name, dnscache.PutRRsetIn(parent, dname.Header().Name, dns.TypeDNAME, []dns.RR{dname}))
+						finalResult = follow([]dns.RR{dname}, substitute(domain, dname), qtype, aliases, t)
+						break NodeLoop
+					}
+					referral := cacheReferral(parent, child, result)
+					if len(referral) > 0 {
+						nameservers[child] = referral
+						// Step 6a or 6b (merged here because of the work done in function nsQuery)
+						parent = child
+						zonecut = true
+					} else { // 6d
+						if ttl := dnscache.NegativeTTL(result.authority); ttl > 0 {
+							rejected(child, dnscache.PutNoDataIn(parent, child, dns.TypeNS, ttl))
+						}
+						cacheDenial(parent, result.authority)
+						zonecut = false
+					}
+				}
+			}
+		}
+		if failed && !staleTried {
+			// A delegation which expired, below the zone whose servers
+			// failed, may still work (RFC 8767)
+			staleTried = true
+			stale, _, _ := dnscache.GetStale(domain, qtype)
+			if stale.Stale && dns.CountLabel(dns.Fqdn(stale.Closest)) > dns.CountLabel(parent) {
+				_, snameservers, _ := dnscache.GetStale(stale.Closest, dns.TypeNS)
+				if len(snameservers) > 0 {
+					if *verbose {
+						fmt.Fprintf(os.Stdout, "Resolution failed, trying again from the stale zone cut \"%s\"\n", stale.Closest)
+					}
+					parent = dns.Fqdn(stale.Closest)
+					pnameservers = snameservers
+					failed = false
+					t.stale = true
+					goto StaleLoop
+				}
+			}
+		}
+	} else if !*ok.Exists {
+		finalResult = "No such domain (in cache)"
+	} else if *ok.NoData {
+		finalResult = "No data of this type (in cache)"
+	} else {
+		finalResult = fmt.Sprintf("Data in cache \"%s\"", rdata)
+	}
+	if failed { // Better an old answer than no answer (RFC 8767)
+		stale, _, srdata := dnscache.GetStale(domain, qtype)
+		if stale.Stale && stale.Exists != nil {
+			if *verbose {
+				fmt.Fprintf(os.Stdout, "Resolution failed, serving stale data\n")
+			}
+			if !*stale.Exists {
+				finalResult = "No such domain (stale)"
+			} else if stale.NoData != nil && *stale.NoData {
+				finalResult = "No data of this type (stale)"
+			} else if stale.NoData != nil {
+				finalResult = fmt.Sprintf("Stale data in cache \"%s\"", srdata)
+			}
+		}
+	}
+	// TODO: check we have data of the requested type?
+	return finalResult
+}
+
 func main() {
-	nameservers := make(map[string]string)
 	timeout = time.Duration(TIMEOUT * 1.0e9)
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
@@ -141,11 +923,36 @@ func main() {
 	verbose = flag.Bool("v", false, "Be verbose")
 	maxTrials = flag.Int("n", int(MAXTRIALS), "Number of trials before giving in")
 	timeoutI := flag.Float64("t", float64(TIMEOUT), "Timeout in seconds")
+	maxEntries := flag.Int("c", 0, "Maximum number of entries in the cache (0 for no limit)")
+	maxBytes := flag.Int("m", 0, "Approximate maximum memory used by the cache, in bytes (0 for no limit)")
+	snapshot := flag.String("s", "", "File to load the cache from at startup and to save it to at shutdown")
+	aggressive = flag.Bool("a", false, "Aggressive use of NSEC and NSEC3 records (RFC 8198). They are not validated!")
+	nxCutI := flag.String("x", "strict", "Use of NXDOMAIN for the names below (RFC 8020): strict, off or hardened")
+	staleWindow := flag.Int("w", 0, "Serve data expired less than this number of seconds ago when resolution fails (RFC 8767, 0 to disable)")
+	prefetchHits := flag.Int("p", 0, "Prefetch the entries retrieved at least this number of times before they expire (0 to disable)")
+	prefetchThreshold := flag.Int("r", 30, "With -p, prefetch the entries which expire in less than this number of seconds")
+	idna := flag.Bool("i", false, "Internationalized domain names: U-labels and A-labels (punycode) give the same cache entry")
+	hintsFile := flag.String("hints", "", "File with the root hints, in the named.root format (default: builtin hints)")
+	v4only := flag.Bool("4", false, "Talk to the name servers over IPv4 only")
+	v6only := flag.Bool("6", false, "Talk to the name servers over IPv6 only")
+	preferV6 := flag.Bool("prefer6", false, "Try the IPv6 addresses of the name servers first, then the IPv4 ones (the default is the opposite)")
 	flag.Parse()
 	if *help {
 		flag.Usage()
 		os.Exit(0)
 	}
+	if (*v4only && *v6only) || (*preferV6 && (*v4only || *v6only)) {
+		fmt.Fprintf(os.Stderr, "Only one of -4, -6 and -prefer6\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *v4only {
+		family = FAMILY_ONLY_V4
+	} else if *v6only {
+		family = FAMILY_ONLY_V6
+	} else if *preferV6 {
+		family = FAMILY_PREFER_V6
+	}
 	if *timeoutI <= 0 {
 		fmt.Fprintf(os.Stderr, "Timeout must be positive, not %d\n", *timeoutI)
 		flag.Usage()
@@ -157,16 +964,77 @@ func main() {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if *staleWindow < 0 {
+		fmt.Fprintf(os.Stderr, "Stale window cannot be negative, not %d\n", *staleWindow)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *prefetchHits < 0 {
+		fmt.Fprintf(os.Stderr, "Number of hits for prefetching cannot be negative, not %d\n", *prefetchHits)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if time.Duration(*prefetchThreshold)*time.Second <= PREFETCH_INTERVAL {
+		fmt.Fprintf(os.Stderr, "Prefetch threshold must be more than %s, not %d seconds\n", PREFETCH_INTERVAL, *prefetchThreshold)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *maxEntries < 0 || *maxBytes < 0 {
+		fmt.Fprintf(os.Stderr, "Cache limits cannot be negative\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	switch *nxCutI {
+	case "strict":
+		nxCut = dnscache.NXDomainCutStrict
+	case "off":
+		nxCut = dnscache.NXDomainCutOff
+	case "hardened":
+		nxCut = dnscache.NXDomainCutHardened
+	default:
+		fmt.Fprintf(os.Stderr, "NXDOMAIN cut must be strict, off or hardened, not %s\n", *nxCutI)
+		flag.Usage()
+		os.Exit(1)
+	}
 	if flag.NArg() != 0 {
 		fmt.Fprintf(os.Stderr, "No argument expected, %d arguments received\n", flag.NArg())
 		flag.Usage()
 		os.Exit(1)
 	}
+	hints := dnscache.DefaultHints()
+	if *hintsFile != "" {
+		var err error
+		hints, err = dnscache.LoadHints(*hintsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot load the root hints from %s: %s\n", *hintsFile, err)
+			os.Exit(1)
+		}
+	}
+	dnscache.Default = dnscache.New(dnscache.Options{Hints: hints, MaxEntries: *maxEntries, MaxBytes: *maxBytes,
+		NXDomainCut: nxCut, StaleWindow: time.Duration(*staleWindow) * time.Second, IDNA: *idna})
+	if *snapshot != "" {
+		loadSnapshot(*snapshot)
+	}
+	ttl, primed := prime(hints)
+	go primeLoop(hints, ttl, primed)
 	sock, err := net.Listen("unix", "@"+SOCKET_NAME)
 	if err != nil {
 		panic(err)
 	}
 	defer sock.Close()
+	if *prefetchHits > 0 {
+		go prefetch(uint64(*prefetchHits), time.Duration(*prefetchThreshold)*time.Second)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if *snapshot != "" {
+			saveSnapshot(*snapshot)
+		}
+		sock.Close()
+		os.Exit(0)
+	}()
 	// ReadingLoop:
 	for {
 		fd, err := sock.Accept()
@@ -184,6 +1052,16 @@ func main() {
 		data := string(buf[0:nr])
 		result := strings.SplitN(data, "\000", 2)
 		domain_raw := result[0]
+		if len(result) == 2 && result[1] == "stats" { // Not a query but a request for statistics
+			fd.Write([]byte(statistics()))
+			fd.Close()
+			continue
+		}
+		if len(result) == 2 && (result[1] == "delete" || result[1] == "flush") { // Purge of the cache
+			fd.Write([]byte(purge(domain_raw, result[1])))
+			fd.Close()
+			continue
+		}
 		qtypeI, err := strconv.ParseInt(result[1], 10, 8)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Invalid request\n")
@@ -199,107 +1077,7 @@ func main() {
 		if *verbose {
 			fmt.Fprintf(os.Stdout, "Searching %d for %s\n", qtype, domain)
 		}
-		remainingLabels := dns.SplitDomainName(domain)
-
-		// Step numbers in the program are from
-		// draft-ietf-dnsop-qname-minimisation-02. Other versions may
-		// be different.
-
-		// Start resolving the domain name. Start with the cache (step 0).
-		finalResult := "UNINITIALIZED"
-		_, rnameservers, _ := dnscache.Get("", 0)
-		nameservers["."] = rnameservers[0]
-		ok, _, rdata := dnscache.Get(domain, qtype)
-		if ok.Exists == nil { // Not in the cache
-
-			// Find closest enclosing NS RRset in your cache. Step 1.
-			parent := dns.Fqdn(ok.Closest)
-
-			leaf := false
-		NodeLoop:
-			for !leaf {
-				if *verbose {
-					fmt.Fprintf(os.Stdout, "\nZone cut at \"%s\"\n", parent)
-				}
-
-				// Step 2
-				child := parent
-
-				zonecut := false
-				// InTheZoneLoop:
-				for !zonecut {
-					// Step 3
-					if child == domain {
-						result := nsQuery(domain, nameservers[parent], qtype, false)
-						if !result.retrieved {
-							fmt.Fprintf(os.Stderr, "Error in retrieving the final result: \"%s\"\n", result.msg)
-							break NodeLoop
-						}
-						finalResult = fmt.Sprintf("%s", result.dnsdata)
-						leaf = true
-						zonecut = true
-						break NodeLoop
-					} else {
-						// Step 4
-						if child == "." {
-							child = dns.Fqdn(remainingLabels[len(remainingLabels)-1])
-						} else {
-							child = remainingLabels[len(remainingLabels)-1] + "." + child
-						}
-						remainingLabels = remainingLabels[0 : len(remainingLabels)-1]
-						// Step 5
-						// TODO If you have a negative cache entry for the NS RRset at CHILD,  go back to step 3.
-						// Step 6
-						result := nsQuery(child, nameservers[parent], dns.TypeNS, true)
-						if !result.retrieved {
-							fmt.Fprintf(os.Stderr, "Error in retrieving the intermediate result: \"%s\"\n", result.msg)
-						}
-						if *verbose {
-							fmt.Fprintf(os.Stdout, "Result for \"%s\": %s\n", child, result.msg)
-						}
-						// 6c
-						if result.rcode == dns.RcodeNameError { // NXDOMAIN
-							fmt.Fprintf(os.Stderr, "Name \"%s\" does not exist\n", child)
-							finalResult = "No such domain"
-							dnscache.PutNx(domain)
-							break NodeLoop
-						}
-						if result.rcode != dns.RcodeSuccess { //
-							fmt.Fprintf(os.Stderr, "Fatal error %s\n", result.msg)
-							finalResult = fmt.Sprintf("Fatal error %s", result.msg)
-							break NodeLoop
-						}
-						// TODO put the positive results in the cache
-						referralFound := false
-						for i := range result.dnsdata {
-							ans := result.dnsdata[i]
-							name := ""
-							switch ans.(type) {
-							case *dns.NS:
-								record := ans.(*dns.NS)
-								if record.Header().Name == child { // Some middleboxes add NS records of the parent...
-									name = record.Ns
-									referralFound = true
-									break
-								}
-							}
-							if referralFound {
-								nameservers[child] = name
-								// Step 6a or 6b (merged here because of the work done in function nsQuery)
-								parent = child
-								zonecut = true
-							} else { // 6d
-								zonecut = false
-							}
-						}
-					}
-				}
-			}
-		} else {
-			// TODO separate NXDOMAIn and actual data
-			finalResult = fmt.Sprintf("Data in cache \"%s\"", rdata)
-		}
-		// TODO: check we have data of the requested type?
+		finalResult := resolve(domain, qtype, false, 0, newTask())
 		fd.Write([]byte(fmt.Sprintf("Final result: %s", finalResult)))
 		fd.Close()
 	}
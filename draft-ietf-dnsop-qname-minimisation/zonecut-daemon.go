@@ -6,21 +6,29 @@
 
 // 1) Install Go
 
-// 2) go get github.com/miekg/dns
+// 2) export GOPATH=$(pwd)
 
-// 3) go build zonecut.go
+// 3) go get github.com/miekg/dns
 
-// 4) ./zonecut
+// 4) go build zonecut.go
 
-// 5) TODO the client
+// 5) ./zonecut
 
-// Limitations: only uses one name server per zone. So, it is very
-// brittle: if this name server happens to be broken, resolution will
-// fail.
+// 6) TODO the client
 
-// We cheat a bit by relying on the local resolver to find IP addresses
-// of name servers from their zones. So, we do not process glue
-// records.
+// All the name servers of a zone are kept. When one times out, or
+// replies SERVFAIL or REFUSED, the next one is tried, and resolution
+// fails only when none of them answered.
+
+// The addresses of the name servers come from the glue records of the
+// referrals, if they are in the zone of the server which sent them
+// (in-bailiwick), and from the hints (-hints, or builtin) for the
+// root. For the other name servers, we cheat a bit by relying on the
+// local resolver.
+
+// The name servers are asked over IPv4 first, then IPv6 if IPv4 fails
+// (for instance because it is unreachable), or the opposite with
+// -prefer6. -4 and -6 use only one family, without fallback.
 
 // Stephane Bortzmeyer <bortzmeyer@nic.fr>
 
@@ -36,36 +44,46 @@ import (
 	"strings"
 	"strconv"
 	"github.com/miekg/dns"
+	"dnscache"
 )
 
 const (
-	ROOT_NS string = "k.root-servers.net" // In the future, we
-	// will have the full array and the ability
-	// to switch away from a broken name server.
 	TIMEOUT     float64 = float64(1.5)
 	MAXTRIALS   uint    = 3
 	QTYPE       uint16  = dns.TypeA
 	SOCKET_NAME string  = "/tmp/zonecut.sock"
 )
 
+// Address family policy, for the transport to the name servers
+const (
+	FAMILY_PREFER_V4 = iota // Default
+	FAMILY_PREFER_V6
+	FAMILY_ONLY_V4
+	FAMILY_ONLY_V6
+)
+
 type Reply struct {
 	retrieved     bool
 	rcode         int
 	authoritative bool
 	dnsdata       []dns.RR
+	additional    []dns.RR // For the glue
 	msg           string
+	server        string // The one which replied
 }
 
 var ( // Global vars
-	nameservers map[string]string
+	nameservers map[string][]string
+	addresses   *dnscache.Cache // Only for the addresses of the name servers, from the glue and the hints
 	timeout     time.Duration
 	maxTrials   *int
 	qtypeI      int
 	qtype       uint16
 	verbose     *bool
+	family      int
 )
 
-func nsQuery(qname string, server string, qtype uint16, acceptReferrals bool) Reply {
+func nsQuery(qname string, server string, address string, qtype uint16, acceptReferrals bool) Reply {
 	var (
 		trials uint
 		result Reply
@@ -80,9 +98,9 @@ func nsQuery(qname string, server string, qtype uint16, acceptReferrals bool) Re
 	c.ReadTimeout = timeout
 	m.Question[0] = dns.Question{qname, qtype, dns.ClassINET}
 	nsAddressPort := ""
-	nsAddressPort = net.JoinHostPort(server, "53")
+	nsAddressPort = net.JoinHostPort(address, "53")
 	if *verbose {
-		fmt.Fprintf(os.Stdout, "Querying type %d for name %s at server %s\n", qtype, qname, server)
+		fmt.Fprintf(os.Stdout, "Querying type %d for name %s at server %s (%s)\n", qtype, qname, server, nsAddressPort)
 	}
 	for trials = 0; trials < uint(*maxTrials); trials++ {
 		answer, _, err := c.Exchange(m, nsAddressPort)
@@ -95,6 +113,7 @@ func nsQuery(qname string, server string, qtype uint16, acceptReferrals bool) Re
 		} else {
 			result.rcode = answer.Rcode
 			result.authoritative = answer.Authoritative
+			result.additional = answer.Extra
 			if answer.Rcode != dns.RcodeSuccess {
 				result.msg = dns.RcodeToString[answer.Rcode]
 				break
@@ -126,9 +145,96 @@ func nsQuery(qname string, server string, qtype uint16, acceptReferrals bool) Re
 	return result
 }
 
+// True if another name server of the zone may do better
+func tryNext(result Reply) bool {
+	return !result.retrieved && (result.rcode == dns.RcodeSuccess || // Timeout or network error
+		result.rcode == dns.RcodeServerFailure || result.rcode == dns.RcodeRefused)
+}
+
+// Asks the name servers of the zone, one after the other, until one
+// replies. Each attempt is reported.
+func query(zone string, servers []string, qname string, qtype uint16, acceptReferrals bool) Reply {
+	var result Reply
+	for i, server := range servers {
+		candidates := serverAddresses(server)
+		if len(candidates) == 0 {
+			result = Reply{retrieved: false, msg: fmt.Sprintf("no usable address for %s", server)}
+			fmt.Fprintf(os.Stderr, "Server %s (%d/%d) of \"%s\" skipped: %s\n", server, i+1, len(servers), zone, result.msg)
+			continue
+		}
+		for _, address := range candidates {
+			result = nsQuery(qname, server, address, qtype, acceptReferrals)
+			if result.retrieved || result.rcode != dns.RcodeSuccess { // It replied, the other addresses would say the same
+				break
+			}
+			// May be this family is unreachable, try the other addresses
+			fmt.Fprintf(os.Stderr, "Address %s of %s failed: %s\n", address, server, result.msg)
+		}
+		result.server = server
+		if !tryNext(result) {
+			if *verbose {
+				fmt.Fprintf(os.Stdout, "Server %s (%d/%d) of \"%s\" replied: %s\n", server, i+1, len(servers), zone, result.msg)
+			}
+			return result
+		}
+		fmt.Fprintf(os.Stderr, "Server %s (%d/%d) of \"%s\" failed: %s\n", server, i+1, len(servers), zone, result.msg)
+	}
+	result.msg = fmt.Sprintf("all the %d name servers of \"%s\" failed, the last one with %s", len(servers), zone, result.msg)
+	return result
+}
+
+// The addresses to try, in order, according to the address family
+// policy. With a preference, the other family is kept as a fallback.
+func byFamily(ips []net.IP) []string {
+	v4 := []string{}
+	v6 := []string{}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip.String())
+		} else {
+			v6 = append(v6, ip.String())
+		}
+	}
+	switch family {
+	case FAMILY_ONLY_V4:
+		return v4
+	case FAMILY_ONLY_V6:
+		return v6
+	case FAMILY_PREFER_V6:
+		return append(v6, v4...)
+	}
+	return append(v4, v6...)
+}
+
+// The addresses of a name server, from the glue, in the order of the
+// address family policy. If we do not know them, we ask the system
+// resolver.
+func serverAddresses(server string) []string {
+	known := addresses.Addresses(server) // Unexpired only
+	if len(known) == 0 {
+		if *verbose {
+			fmt.Fprintf(os.Stdout, "No glue for %s, asking the system resolver\n", server)
+		}
+		known, _ = net.LookupIP(server)
+	}
+	return byFamily(known)
+}
+
+// Keeps the addresses of the name servers of a referral, from the
+// additional section. They replace what we knew, for the TTL of the
+// records. Only the ones in the zone of the server which sent them
+// are believed (RFC 2181, section 5.4.1), otherwise the servers of .de
+// could tell us the address of ns.example.com.
+func storeGlue(zone string, referral []string, additional []dns.RR) {
+	for _, ns := range referral {
+		if addresses.PutAddressesIn(zone, ns, additional) != nil && *verbose {
+			fmt.Fprintf(os.Stdout, "Glue for %s ignored, it is not in \"%s\"\n", ns, zone)
+		}
+	}
+}
+
 func main() {
-	nameservers = make(map[string]string)
-	nameservers["."] = ROOT_NS
+	nameservers = make(map[string][]string)
 	timeout = time.Duration(TIMEOUT * 1.0e9)
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
@@ -139,11 +245,38 @@ func main() {
 	verbose = flag.Bool("v", false, "Be verbose")
 	maxTrials = flag.Int("n", int(MAXTRIALS), "Number of trials before giving in")
 	timeoutI := flag.Float64("t", float64(TIMEOUT), "Timeout in seconds")
+	hintsFile := flag.String("hints", "", "File with the root hints, in the named.root format (default: builtin hints)")
+	v4only := flag.Bool("4", false, "Talk to the name servers over IPv4 only")
+	v6only := flag.Bool("6", false, "Talk to the name servers over IPv6 only")
+	preferV6 := flag.Bool("prefer6", false, "Try the IPv6 addresses of the name servers first, then the IPv4 ones (the default is the opposite)")
 	flag.Parse()
 	if *help {
 		flag.Usage()
 		os.Exit(0)
 	}
+	if (*v4only && *v6only) || (*preferV6 && (*v4only || *v6only)) {
+		fmt.Fprintf(os.Stderr, "Only one of -4, -6 and -prefer6\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *v4only {
+		family = FAMILY_ONLY_V4
+	} else if *v6only {
+		family = FAMILY_ONLY_V6
+	} else if *preferV6 {
+		family = FAMILY_PREFER_V6
+	}
+	hints := dnscache.DefaultHints()
+	if *hintsFile != "" {
+		var err error
+		hints, err = dnscache.LoadHints(*hintsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot load the root hints from %s: %s\n", *hintsFile, err)
+			os.Exit(1)
+		}
+	}
+	addresses = dnscache.New(dnscache.Options{Hints: hints})
+	nameservers["."] = hints.Servers
 	if *timeoutI <= 0 {
 		fmt.Fprintf(os.Stderr, "Timeout must be positive, not %d\n", *timeoutI)
 		flag.Usage()
@@ -222,7 +355,7 @@ func main() {
 			for !zonecut {
 				// Step 3
 				if child == domain {
-					result := nsQuery(domain, nameservers[parent], qtype, false)
+					result := query(parent, nameservers[parent], domain, qtype, false)
 					if !result.retrieved {
 						fmt.Fprintf(os.Stderr, "Error in retrieving the final result: \"%s\"\n", result.msg)
 						os.Exit(1)
@@ -241,7 +374,7 @@ func main() {
 					remainingLabels = remainingLabels[0 : len(remainingLabels)-1]
 					// Step 5 skipped since we don't have a cache
 					// Step 6
-					result := nsQuery(child, nameservers[parent], dns.TypeNS, true)
+					result := query(parent, nameservers[parent], child, dns.TypeNS, true)
 					if !result.retrieved {
 						fmt.Fprintf(os.Stderr, "Error in retrieving the intermediate result: \"%s\"\n", result.msg)
 						os.Exit(1)
@@ -258,27 +391,25 @@ func main() {
 						fmt.Fprintf(os.Stderr, "Fatal error %s\n", result.msg)
 						os.Exit(1)
 					}
-					referralFound := false
+					referral := []string{}
 					for i := range result.dnsdata {
 						ans := result.dnsdata[i]
-						name := ""
 						switch ans.(type) {
 						case *dns.NS:
 							record := ans.(*dns.NS)
 							if record.Header().Name == child { // Some middleboxes add NS records of the parent...
-								name = record.Ns
-								referralFound = true
-								break
+								referral = append(referral, record.Ns)
 							}
 						}
-						if referralFound {
-							nameservers[child] = name
-							// Step 6a or 6b (merged here because of the work done in function nsQuery)
-							parent = child
-							zonecut = true
-						} else { // 6d
-							zonecut = false
-						}
+					}
+					if len(referral) > 0 {
+						nameservers[child] = referral
+						storeGlue(parent, referral, result.additional)
+						// Step 6a or 6b (merged here because of the work done in function nsQuery)
+						parent = child
+						zonecut = true
+					} else { // 6d
+						zonecut = false
 					}
 				}
 			}